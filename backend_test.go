@@ -0,0 +1,311 @@
+package bw2util
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/objects"
+	bw2 "github.com/immesys/bw2bind"
+)
+
+// an in-memory registry and agent implementing bwBackend, so the chain search and the subscribe, query
+// and publish paths can be tested without a live agent
+type fakeBackend struct {
+	sync.Mutex
+	// alias or base64 hash -> the object the registry resolves it to
+	entries map[string]objects.RoutingObject
+	// base64 hash -> validity, for anything that isn't StateValid
+	validity map[string]bw2.RegistryValidity
+	// base64 giver VK -> the DOTs it has granted, in the order FindDOTsFromVK returns them
+	granted map[string][]objects.RoutingObject
+	// added to every FindDOTsFromVK and ResolveRegistry call, to stand in for a remote registry
+	lookupDelay  time.Duration
+	resolveDelay time.Duration
+	// the next failResolves ResolveRegistry calls fail, to stand in for a flaky registry
+	failResolves int
+	// the messages Query returns and Subscribe delivers, by URI
+	messages map[string][]*bw2.SimpleMessage
+	// if non-nil, these replace the default behaviour of SubscribeH and Query
+	subscribeFn func(p *bw2.SubscribeParams) (chan *bw2.SimpleMessage, string, error)
+	queryFn     func(p *bw2.QueryParams) (chan *bw2.SimpleMessage, error)
+
+	// what the client asked for
+	resolves     []string
+	lookups      []string
+	subscribes   []*bw2.SubscribeParams
+	queries      []*bw2.QueryParams
+	publishes    []*bw2.PublishParams
+	unsubscribed []string
+	// handle -> open subscription channel
+	open    map[string]chan *bw2.SimpleMessage
+	handles int
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		entries:  make(map[string]objects.RoutingObject),
+		validity: make(map[string]bw2.RegistryValidity),
+		granted:  make(map[string][]objects.RoutingObject),
+		messages: make(map[string][]*bw2.SimpleMessage),
+		open:     make(map[string]chan *bw2.SimpleMessage),
+	}
+}
+
+func (f *fakeBackend) ResolveRegistry(key string) (objects.RoutingObject, bw2.RegistryValidity, error) {
+	time.Sleep(f.resolveDelay)
+	f.Lock()
+	defer f.Unlock()
+	f.resolves = append(f.resolves, key)
+	if f.failResolves > 0 {
+		f.failResolves--
+		return nil, bw2.StateUnknown, fmt.Errorf("registry unavailable")
+	}
+	ro, found := f.entries[key]
+	if !found {
+		return nil, bw2.StateUnknown, fmt.Errorf("%s is not in the registry", key)
+	}
+	return ro, f.validityOf(key), nil
+}
+
+func (f *fakeBackend) FindDOTsFromVK(vk string) ([]objects.RoutingObject, []bw2.RegistryValidity, error) {
+	time.Sleep(f.lookupDelay)
+	f.Lock()
+	defer f.Unlock()
+	f.lookups = append(f.lookups, vk)
+	dots := f.granted[vk]
+	valids := make([]bw2.RegistryValidity, len(dots))
+	for i, ro := range dots {
+		valids[i] = f.validityOf(fmtHash(ro.(*objects.DOT).GetHash()))
+	}
+	return dots, valids, nil
+}
+
+func (f *fakeBackend) validityOf(key string) bw2.RegistryValidity {
+	if validity, found := f.validity[key]; found {
+		return validity
+	}
+	return bw2.StateValid
+}
+
+func (f *fakeBackend) SubscribeH(p *bw2.SubscribeParams) (chan *bw2.SimpleMessage, string, error) {
+	f.Lock()
+	f.subscribes = append(f.subscribes, p)
+	fn := f.subscribeFn
+	f.Unlock()
+	if fn != nil {
+		return fn(p)
+	}
+	return f.liveSubscribe(p)
+}
+
+// what SubscribeH does by default: delivers the messages for the URI on a subscription that stays open
+func (f *fakeBackend) liveSubscribe(p *bw2.SubscribeParams) (chan *bw2.SimpleMessage, string, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.handles++
+	handle := fmt.Sprintf("sub-%d", f.handles)
+	msgs := make(chan *bw2.SimpleMessage, len(f.messages[p.URI]))
+	for _, msg := range f.messages[p.URI] {
+		msgs <- msg
+	}
+	// left open like a live subscription, until Unsubscribe
+	f.open[handle] = msgs
+	return msgs, handle, nil
+}
+
+func (f *fakeBackend) Unsubscribe(handle string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.unsubscribed = append(f.unsubscribed, handle)
+	if msgs, found := f.open[handle]; found {
+		close(msgs)
+		delete(f.open, handle)
+	}
+	return nil
+}
+
+func (f *fakeBackend) Query(p *bw2.QueryParams) (chan *bw2.SimpleMessage, error) {
+	f.Lock()
+	f.queries = append(f.queries, p)
+	fn := f.queryFn
+	f.Unlock()
+	if fn != nil {
+		return fn(p)
+	}
+	f.Lock()
+	defer f.Unlock()
+	msgs := make(chan *bw2.SimpleMessage, len(f.messages[p.URI]))
+	for _, msg := range f.messages[p.URI] {
+		msgs <- msg
+	}
+	close(msgs)
+	return msgs, nil
+}
+
+func (f *fakeBackend) Publish(p *bw2.PublishParams) error {
+	f.Lock()
+	defer f.Unlock()
+	f.publishes = append(f.publishes, p)
+	return nil
+}
+
+// the URIs subscribed to, sorted
+func (f *fakeBackend) subscribedURIs() []string {
+	f.Lock()
+	defer f.Unlock()
+	var uris []string
+	for _, p := range f.subscribes {
+		uris = append(uris, p.URI)
+	}
+	return sortedCopy(uris)
+}
+
+// registers a namespace or other entity under an alias
+func (f *fakeBackend) alias(name string, entity *objects.Entity) {
+	f.Lock()
+	defer f.Unlock()
+	f.entries[name] = entity
+}
+
+// grants an access DOT from one entity to another on a suffix of the namespace. perms holds the
+// letters of the permissions to grant: C (consume), T (tap), P (publish) and L (list)
+func (f *fakeBackend) grant(from, to, ns *objects.Entity, suffix, perms string) *objects.DOT {
+	return f.grantTo(from, to.GetVK(), ns, suffix, perms)
+}
+
+func (f *fakeBackend) grantTo(from *objects.Entity, to []byte, ns *objects.Entity, suffix, perms string) *objects.DOT {
+	dot := objects.CreateDOT(true, from.GetVK(), to)
+	dot.SetAccessURI(ns.GetVK(), suffix)
+	dot.SetCanConsume(strings.Contains(perms, "C"), strings.Contains(perms, "C"), strings.Contains(perms, "C"))
+	dot.SetCanTap(strings.Contains(perms, "T"), strings.Contains(perms, "T"), strings.Contains(perms, "T"))
+	dot.SetCanPublish(strings.Contains(perms, "P"))
+	dot.SetCanList(strings.Contains(perms, "L"))
+	dot.SetTTL(DefaultMaxChainLength)
+	dot.Encode(from.GetSK())
+	f.add(dot)
+	return dot
+}
+
+// lists the DOT under its giver and makes it resolvable by its hash
+func (f *fakeBackend) add(dot *objects.DOT) {
+	f.Lock()
+	defer f.Unlock()
+	giver := fmtHash(dot.GetGiverVK())
+	f.granted[giver] = append(f.granted[giver], dot)
+	f.entries[fmtHash(dot.GetHash())] = dot
+}
+
+// an elaborated access chain of the DOTs
+func testChain(t testing.TB, dots ...*objects.DOT) *objects.DChain {
+	dchain, err := objects.CreateDChain(true, dots...)
+	if err != nil {
+		t.Fatalf("CreateDChain: %v", err)
+	}
+	return dchain
+}
+
+// the same chain carrying only the hashes of its DOTs, as it arrives when it isn't elaborated
+func hashOnly(t testing.TB, dchain *objects.DChain) *objects.DChain {
+	var content []byte
+	for i := 0; i < dchain.NumHashes(); i++ {
+		content = append(content, dchain.GetDotHash(i)...)
+	}
+	ro, err := objects.NewDChain(objects.ROAccessDChainHash, content)
+	if err != nil {
+		t.Fatalf("NewDChain: %v", err)
+	}
+	return ro.(*objects.DChain)
+}
+
+func newEntity() *objects.Entity {
+	return objects.CreateNewEntity("", "", nil)
+}
+
+// an entity whose VK is written differently in standard and URL-safe base64
+func newStdEntity() *objects.Entity {
+	for {
+		entity := newEntity()
+		if base64.StdEncoding.EncodeToString(entity.GetVK()) != vkOf(entity) {
+			return entity
+		}
+	}
+}
+
+func vkOf(entity *objects.Entity) string {
+	return fmtHash(entity.GetVK())
+}
+
+// a client acting as a fresh entity, with a namespace registered as test.ns
+type testWorld struct {
+	bw *fakeBackend
+	ns *objects.Entity
+	me *objects.Entity
+	c  *Client
+}
+
+func newTestWorld(t testing.TB) *testWorld {
+	w := &testWorld{
+		bw: newFakeBackend(),
+		ns: newEntity(),
+		me: newEntity(),
+	}
+	w.bw.alias("test.ns", w.ns)
+	c, err := newClientFromBackend(w.bw, vkOf(w.me))
+	if err != nil {
+		t.Fatalf("newClientFromBackend: %v", err)
+	}
+	w.c = c
+	return w
+}
+
+// a payload object with arbitrary contents
+type testPO struct {
+	ponum    int
+	contents []byte
+}
+
+func (po testPO) GetPONum() int { return po.ponum }
+func (po testPO) GetPODotNum() string {
+	return fmt.Sprintf("%d.%d.%d.%d", po.ponum>>24, (po.ponum>>16)&0xff, (po.ponum>>8)&0xff, po.ponum&0xff)
+}
+func (po testPO) TextRepresentation() string  { return string(po.contents) }
+func (po testPO) GetContents() []byte         { return po.contents }
+func (po testPO) IsType(ponum, mask int) bool { return po.ponum&mask == ponum&mask }
+func (po testPO) IsTypeDF(df string) bool     { return po.GetPODotNum() == df }
+
+// a message with the given signature and a single payload object
+func testMessage(uri, signature string, po testPO) *bw2.SimpleMessage {
+	return &bw2.SimpleMessage{
+		URI:       uri,
+		POs:       []bw2.PayloadObject{po},
+		Signature: []byte(signature),
+	}
+}
+
+func sortedCopy(s []string) []string {
+	out := append([]string(nil), s...)
+	sort.Strings(out)
+	return out
+}
+
+// reads from msgs until it is closed, failing the test if that takes too long
+func drain(t testing.TB, msgs chan *bw2.SimpleMessage) []*bw2.SimpleMessage {
+	var got []*bw2.SimpleMessage
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return got
+			}
+			got = append(got, msg)
+		case <-timeout:
+			t.Fatalf("channel not closed after %d messages", len(got))
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package bw2util
+
+import (
+	"time"
+
+	"github.com/immesys/bw2/objects"
+)
+
+// cached chains are stored under the namespace, then under our VK and the kind of chain
+
+func (c *Client) chainCacheKey(filter permFilter) string {
+	return c.vk + "|" + filter.name
+}
+
+// returns the cached chains for the namespace, if caching is enabled and they haven't expired. The slice
+// is a copy, so callers may change it without touching the cache
+func (c *Client) getCachedChains(namespace string, filter permFilter) ([]*objects.DChain, bool) {
+	if c.ChainCacheTTL == 0 {
+		return nil, false
+	}
+	item := c.chainCache.Get(namespace, c.chainCacheKey(filter))
+	if item == nil || item.Expired() {
+		return nil, false
+	}
+	return copyChains(item.Value().([]*objects.DChain)), true
+}
+
+// stores the chains if caching is enabled. The entry expires after ChainCacheTTL, or when the
+// first DOT in any of the chains expires (less the ExpiryGrace), whichever is sooner. A copy of the slice
+// is stored, so the caller may go on to change its own
+func (c *Client) cacheChains(namespace string, filter permFilter, dchains []*objects.DChain) {
+	if c.ChainCacheTTL == 0 {
+		return
+	}
+	ttl := c.ChainCacheTTL
+	now := time.Now()
+	for _, dchain := range dchains {
+		expiry := chainExpiry(dchain)
+		if expiry == nil {
+			continue
+		}
+		if left := expiry.Sub(now) - c.ExpiryGrace; left < ttl {
+			ttl = left
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.chainCache.Set(namespace, c.chainCacheKey(filter), copyChains(dchains), ttl)
+}
+
+func copyChains(dchains []*objects.DChain) []*objects.DChain {
+	return append([]*objects.DChain(nil), dchains...)
+}
+
+// Drops any cached chains for the given namespace VK, so the next lookup searches the registry again
+func (c *Client) InvalidateChainCache(namespace string) {
+	c.chainCache.DeleteAll(canonicalVK(namespace))
+}
@@ -0,0 +1,78 @@
+package bw2util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/objects"
+)
+
+func TestChainCache(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "a/*", "C")
+	w.bw.grant(w.ns, w.me, w.ns, "b/*", "C")
+	w.c.ChainCacheTTL = time.Hour
+	nsvk := vkOf(w.ns)
+	find := func() []*objects.DChain {
+		dchains, err := w.c.FindDOTChains(nsvk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dchains
+	}
+
+	first := find()
+	searches := len(w.bw.lookups)
+	// changing what we got back doesn't change what later callers get
+	first[0] = nil
+	second := find()
+	if len(w.bw.lookups) != searches {
+		t.Errorf("searched again with the chains cached")
+	}
+	if len(second) != 2 || second[0] == nil {
+		t.Fatalf("the cached chains were changed through a returned slice: %v", second)
+	}
+	second[0], second[1] = second[1], second[0]
+	if third := find(); !ChainsEqual(third[0], second[1]) {
+		t.Errorf("the cached chains were reordered through a returned slice")
+	}
+
+	w.c.InvalidateChainCache(nsvk)
+	find()
+	if len(w.bw.lookups) != searches+1 {
+		t.Errorf("InvalidateChainCache didn't make the next lookup search again")
+	}
+
+	w.c.InvalidateChainCache(nsvk)
+	w.c.ChainCacheTTL = 20 * time.Millisecond
+	find()
+	time.Sleep(50 * time.Millisecond)
+	find()
+	if len(w.bw.lookups) != searches+3 {
+		t.Errorf("cached chains outlived ChainCacheTTL")
+	}
+}
+
+func TestChainCacheExpiresWithDOTs(t *testing.T) {
+	w := newTestWorld(t)
+	dot := objects.CreateDOT(true, w.ns.GetVK(), w.me.GetVK())
+	dot.SetAccessURI(w.ns.GetVK(), "*")
+	dot.SetCanConsume(true, true, true)
+	dot.SetTTL(DefaultMaxChainLength)
+	dot.SetExpiry(time.Now().Add(50 * time.Millisecond))
+	dot.Encode(w.ns.GetSK())
+	w.bw.add(dot)
+	w.c.ChainCacheTTL = time.Hour
+
+	if dchains, err := w.c.FindDOTChains(vkOf(w.ns)); err != nil || len(dchains) != 1 {
+		t.Fatalf("got %d chains and %v, want 1", len(dchains), err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	dchains, err := w.c.FindDOTChains(vkOf(w.ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dchains) != 0 || len(w.bw.lookups) != 2 {
+		t.Errorf("got %d chains after %d searches, want the expired chain dropped by a new search", len(dchains), len(w.bw.lookups))
+	}
+}
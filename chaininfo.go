@@ -0,0 +1,305 @@
+package bw2util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/immesys/bw2/objects"
+)
+
+// Describes a DOT chain found by FindDOTChainsInfo
+type ChainInfo struct {
+	Chain *objects.DChain
+	// number of DOTs in the chain
+	Length int
+	// the URI this chain lets us use, from GetDChainURI. Empty if the chain
+	// does not overlap the requested URI
+	URI string
+	// the expiry of the DOT in the chain that expires first; nil if none of them expire
+	EarliestExpiry *time.Time
+	// the VKs the chain passes through in order, starting with the namespace and ending with us
+	VKs []string
+	// the permissions the chain actually grants, from ChainPermissions
+	Permissions *objects.AccessDOTPermissionSet
+	// the metadata of each DOT in the chain in order, e.g. to show why the chain exists
+	DOTs []DOTInfo
+}
+
+// The metadata of one DOT in a chain, as given by whoever granted it
+type DOTInfo struct {
+	Hash string
+	// free-form text such as "granted for project X"; empty if not given
+	Comment string
+	// how to reach the granter; empty if not given
+	Contact string
+	// nil if the DOT does not say when it was created
+	Created *time.Time
+	// nil if the DOT never expires
+	Expiry *time.Time
+}
+
+// Same as FindDOTChains, but returns a ChainInfo for each chain. The effective URI of each chain is
+// computed against the given uri
+func (c *Client) FindDOTChainsInfo(namespace, uri string) ([]ChainInfo, error) {
+	dchains, err := c.FindDOTChains(namespace)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]ChainInfo, len(dchains))
+	for i, dchain := range dchains {
+		infos[i] = newChainInfo(dchain, uri)
+	}
+	return infos, nil
+}
+
+// populates a ChainInfo from an elaborated dchain
+func newChainInfo(dchain *objects.DChain, uri string) ChainInfo {
+	info := ChainInfo{
+		Chain:          dchain,
+		Length:         dchain.NumHashes(),
+		URI:            GetDChainURI(dchain, uri),
+		EarliestExpiry: chainExpiry(dchain),
+	}
+	// chains from FindDOTChains are elaborated access chains, so this can't fail
+	info.Permissions, _ = ChainPermissions(dchain)
+	info.VKs = chainVKs(dchain)
+	info.DOTs = chainDOTInfo(dchain)
+	return info
+}
+
+// the metadata of each DOT of an elaborated chain in order
+func chainDOTInfo(dchain *objects.DChain) []DOTInfo {
+	infos := make([]DOTInfo, dchain.NumHashes())
+	for i := range infos {
+		dot := dchain.GetDOT(i)
+		infos[i] = DOTInfo{
+			Hash:    fmtHash(dot.GetHash()),
+			Comment: dot.GetComment(),
+			Contact: dot.GetContact(),
+			Created: dot.GetCreated(),
+			Expiry:  dot.GetExpiry(),
+		}
+	}
+	return infos
+}
+
+// the VKs an elaborated chain passes through in order, starting with the giver of the first DOT
+func chainVKs(dchain *objects.DChain) []string {
+	var vks []string
+	for i := 0; i < dchain.NumHashes(); i++ {
+		dot := dchain.GetDOT(i)
+		if i == 0 {
+			vks = append(vks, fmtHash(dot.GetGiverVK()))
+		}
+		vks = append(vks, fmtHash(dot.GetReceiverVK()))
+	}
+	return vks
+}
+
+// returns the expiry of the DOT in the chain that expires first, or nil if none of them expire
+func chainExpiry(dchain *objects.DChain) *time.Time {
+	var earliest *time.Time
+	for i := 0; i < dchain.NumHashes(); i++ {
+		if expiry := dchain.GetDOT(i).GetExpiry(); expiry != nil && (earliest == nil || expiry.Before(*earliest)) {
+			earliest = expiry
+		}
+	}
+	return earliest
+}
+
+// Returns the permissions a chain actually grants, which are the intersection of the permissions of
+// each of its DOTs. The chain must be an elaborated access chain
+func ChainPermissions(dchain *objects.DChain) (*objects.AccessDOTPermissionSet, error) {
+	perms := allPermissions()
+	for i := 0; i < dchain.NumHashes(); i++ {
+		dot := dchain.GetDOT(i)
+		if dot == nil {
+			return nil, notElaborated(dchain)
+		}
+		if !dot.IsAccess() {
+			return nil, fmt.Errorf("DOT %s is not an access DOT", fmtHash(dot.GetHash()))
+		}
+		p := dot.GetPermissionSet()
+		perms.CanPublish = perms.CanPublish && p.CanPublish
+		perms.CanConsume = perms.CanConsume && p.CanConsume
+		perms.CanConsumePlus = perms.CanConsumePlus && p.CanConsumePlus
+		perms.CanConsumeStar = perms.CanConsumeStar && p.CanConsumeStar
+		perms.CanTap = perms.CanTap && p.CanTap
+		perms.CanTapPlus = perms.CanTapPlus && p.CanTapPlus
+		perms.CanTapStar = perms.CanTapStar && p.CanTapStar
+		perms.CanList = perms.CanList && p.CanList
+	}
+	return perms, nil
+}
+
+// every access permission, as held by the owner of a namespace
+func allPermissions() *objects.AccessDOTPermissionSet {
+	return &objects.AccessDOTPermissionSet{
+		CanPublish:     true,
+		CanConsume:     true,
+		CanConsumePlus: true,
+		CanConsumeStar: true,
+		CanTap:         true,
+		CanTapPlus:     true,
+		CanTapStar:     true,
+		CanList:        true,
+	}
+}
+
+// Returns true if the chain stops granting access before t, i.e. one of its DOTs expires before then.
+// Chains that never expire (EarliestExpiry is nil) never do
+func (info ChainInfo) WillExpireBefore(t time.Time) bool {
+	return info.EarliestExpiry != nil && info.EarliestExpiry.Before(t)
+}
+
+// the JSON form of a ChainInfo. Hashes and VKs are in the same base64 encoding as the rest of the package
+type chainInfoJSON struct {
+	Hash           string          `json:"hash"`
+	DOTs           []string        `json:"dots"`
+	Length         int             `json:"length"`
+	URI            string          `json:"uri,omitempty"`
+	EarliestExpiry *time.Time      `json:"earliest_expiry,omitempty"`
+	VKs            []string        `json:"vks"`
+	Permissions    *permissionJSON `json:"permissions,omitempty"`
+	DOTInfo        []dotInfoJSON   `json:"dot_info,omitempty"`
+}
+
+type dotInfoJSON struct {
+	Hash    string     `json:"hash"`
+	Comment string     `json:"comment,omitempty"`
+	Contact string     `json:"contact,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+	Expiry  *time.Time `json:"expiry,omitempty"`
+}
+
+type permissionJSON struct {
+	CanPublish     bool `json:"publish"`
+	CanConsume     bool `json:"consume"`
+	CanConsumePlus bool `json:"consume_plus"`
+	CanConsumeStar bool `json:"consume_star"`
+	CanTap         bool `json:"tap"`
+	CanTapPlus     bool `json:"tap_plus"`
+	CanTapStar     bool `json:"tap_star"`
+	CanList        bool `json:"list"`
+}
+
+// Encodes the ChainInfo as a read-only JSON view: the ChainHash of the chain, the hashes of its DOTs
+// in order, and the rest of the ChainInfo fields, with the DOT metadata under dot_info. The chain
+// itself can be recovered from the DOT hashes by resolving them in the registry
+func (info ChainInfo) MarshalJSON() ([]byte, error) {
+	v := chainInfoJSON{
+		Length:         info.Length,
+		URI:            info.URI,
+		EarliestExpiry: info.EarliestExpiry,
+		VKs:            info.VKs,
+		DOTs:           []string{},
+	}
+	if info.Chain != nil {
+		v.Hash = ChainHash(info.Chain)
+		for i := 0; i < info.Chain.NumHashes(); i++ {
+			v.DOTs = append(v.DOTs, fmtHash(info.Chain.GetDotHash(i)))
+		}
+	}
+	if p := info.Permissions; p != nil {
+		v.Permissions = &permissionJSON{
+			CanPublish:     p.CanPublish,
+			CanConsume:     p.CanConsume,
+			CanConsumePlus: p.CanConsumePlus,
+			CanConsumeStar: p.CanConsumeStar,
+			CanTap:         p.CanTap,
+			CanTapPlus:     p.CanTapPlus,
+			CanTapStar:     p.CanTapStar,
+			CanList:        p.CanList,
+		}
+	}
+	for _, dot := range info.DOTs {
+		v.DOTInfo = append(v.DOTInfo, dotInfoJSON(dot))
+	}
+	return json.Marshal(v)
+}
+
+// Returns how many more times a chain can be delegated: each DOT caps the TTL at its own TTL, and each
+// DOT after the first uses one up. A negative result means the chain is already longer than its DOTs
+// allow. This is the chain's own GetTTL, which the rest of the package uses too, but the chain is checked
+// to be elaborated first
+func ChainTTL(dchain *objects.DChain) (int, error) {
+	for i := 0; i < dchain.NumHashes(); i++ {
+		if dchain.GetDOT(i) == nil {
+			return 0, notElaborated(dchain)
+		}
+	}
+	return dchain.GetTTL(), nil
+}
+
+// Returns the expiry of each DOT in the chain, in order. DOTs that never expire have the zero time
+// (check with IsZero). The chain must be elaborated
+func ChainExpiries(dchain *objects.DChain) ([]time.Time, error) {
+	expiries := make([]time.Time, dchain.NumHashes())
+	for i := range expiries {
+		dot := dchain.GetDOT(i)
+		if dot == nil {
+			return nil, notElaborated(dchain)
+		}
+		if expiry := dot.GetExpiry(); expiry != nil {
+			expiries[i] = *expiry
+		}
+	}
+	return expiries, nil
+}
+
+// Describes a chain on one line for logging, e.g. "ns AbCdEfGh: AbCdEfGh -> IjKlMnOp -> QrStUvWx on a/b/* (C*P)"
+// with each VK cut down to its first 8 characters. The URI suffix is what the chain as a whole grants
+func ChainString(dchain *objects.DChain) string {
+	if dchain.NumHashes() == 0 {
+		return "empty chain"
+	}
+	var buf bytes.Buffer
+	first := dchain.GetDOT(0)
+	if first == nil {
+		buf.WriteString("unelaborated chain ")
+		buf.WriteString(shortVK(fmtHash(dchain.GetChainHash())))
+		return buf.String()
+	}
+	buf.WriteString("ns ")
+	buf.WriteString(shortVK(fmtHash(first.GetAccessURIMVK())))
+	buf.WriteString(":")
+	suffix, overlap := "*", true
+	for i := 0; i < dchain.NumHashes(); i++ {
+		dot := dchain.GetDOT(i)
+		if dot == nil {
+			buf.WriteString(" ... (not elaborated)")
+			return buf.String()
+		}
+		if i == 0 {
+			buf.WriteString(" ")
+			buf.WriteString(shortVK(fmtHash(dot.GetGiverVK())))
+		}
+		buf.WriteString(" -> ")
+		buf.WriteString(shortVK(fmtHash(dot.GetReceiverVK())))
+		if overlap {
+			suffix, overlap = RestrictURI(dot.GetAccessURISuffix(), suffix)
+		}
+	}
+	if overlap {
+		buf.WriteString(" on ")
+		buf.WriteString(suffix)
+	} else {
+		buf.WriteString(" on nothing")
+	}
+	if perms, err := ChainPermissions(dchain); err == nil {
+		buf.WriteString(" (")
+		buf.WriteString(permString(perms))
+		buf.WriteString(")")
+	}
+	return buf.String()
+}
+
+// the first 8 characters of a VK or hash
+func shortVK(vk string) string {
+	if len(vk) > 8 {
+		return vk[:8]
+	}
+	return vk
+}
@@ -0,0 +1,77 @@
+package bw2util
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/pkg/errors"
+)
+
+func TestChainTTL(t *testing.T) {
+	w := newTestWorld(t)
+	a, b := newEntity(), newEntity()
+	for _, tc := range []struct {
+		ttls []int
+		want int
+	}{
+		{[]int{3}, 3},
+		{[]int{3, 3}, 2},
+		{[]int{5, 1}, 1},
+		{[]int{1, 5}, 0},
+		{[]int{0, 5, 5}, -2},
+		{[]int{5, 5, 0}, 0},
+	} {
+		vks := []*objects.Entity{w.ns, a, b, w.me}
+		var dots []*objects.DOT
+		for i, ttl := range tc.ttls {
+			to := vks[i+1]
+			if i == len(tc.ttls)-1 {
+				to = w.me
+			}
+			dot := objects.CreateDOT(true, vks[i].GetVK(), to.GetVK())
+			dot.SetAccessURI(w.ns.GetVK(), "*")
+			dot.SetCanConsume(true, true, true)
+			dot.SetTTL(ttl)
+			dot.Encode(vks[i].GetSK())
+			dots = append(dots, dot)
+		}
+		dchain := testChain(t, dots...)
+		ttl, err := ChainTTL(dchain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl != tc.want || ttl != dchain.GetTTL() {
+			t.Errorf("ChainTTL of DOT TTLs %v = %d (GetTTL %d), want %d", tc.ttls, ttl, dchain.GetTTL(), tc.want)
+		}
+		if live := liveChains([]*objects.DChain{dchain}, canConsume); (len(live) == 1) != (ttl >= 0) {
+			t.Errorf("DOT TTLs %v: liveChains disagrees with ChainTTL %d", tc.ttls, ttl)
+		}
+	}
+	if _, err := ChainTTL(hashOnly(t, testChain(t, w.bw.grant(w.ns, w.me, w.ns, "*", "C")))); errors.Cause(err) != ErrNotElaborated {
+		t.Errorf("got %v for an unelaborated chain, want %v", err, ErrNotElaborated)
+	}
+}
+
+func TestChainInfoJSONHash(t *testing.T) {
+	w := newTestWorld(t)
+	a := newEntity()
+	dchain := testChain(t, w.bw.grant(w.ns, a, w.ns, "*", "C"), w.bw.grant(a, w.me, w.ns, "*", "C"))
+	raw, err := json.Marshal(newChainInfo(dchain, "test.ns/*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		Hash string   `json:"hash"`
+		DOTs []string `json:"dots"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Hash != ChainHash(dchain) {
+		t.Errorf("got hash %s, want ChainHash %s", v.Hash, ChainHash(dchain))
+	}
+	if len(v.DOTs) != 2 {
+		t.Errorf("got %d DOT hashes, want 2", len(v.DOTs))
+	}
+}
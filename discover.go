@@ -0,0 +1,53 @@
+package bw2util
+
+import (
+	"context"
+	"sort"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/pkg/errors"
+)
+
+// Returns the namespace VKs (base64 encoded) for which we hold at least one valid consume chain.
+// The registry only indexes DOTs by the VK that granted them, so the candidate namespaces are those of
+// the consume DOTs we have granted to others; each candidate is then confirmed by searching for a chain
+// from the namespace to us. Namespaces we have access to but have never delegated on are not found
+func (c *Client) DiscoverNamespaces() ([]string, error) {
+	dots, err := c.findDOTsFromVK(context.Background(), c.vk, canConsume, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not find DOTS from vk")
+	}
+	candidates := make(map[string]struct{})
+	for _, dot := range dots {
+		candidates[fmtHash(dot.GetAccessURIMVK())] = struct{}{}
+	}
+
+	var namespaces []string
+	for namespace := range candidates {
+		dchains, err := c.FindDOTChains(namespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not find DOT chains on %s", namespace)
+		}
+		if len(dchains) > 0 {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// Finds every valid consume chain rooted at the namespace VK, grouped by the (base64 encoded) VK each
+// chain grants access to. This follows DOTs outward from the namespace, so it is the set of VKs that can
+// currently consume from some part of the namespace, and how
+func (c *Client) FindConsumersOfNamespace(namespace string) (map[string][]*objects.DChain, error) {
+	dchains, err := c.buildChains(context.Background(), namespace, "", namespace, canConsume, nil)
+	if err != nil {
+		return nil, err
+	}
+	consumers := make(map[string][]*objects.DChain)
+	for _, dchain := range dchains {
+		recvVK := fmtHash(dchain.GetDOT(dchain.NumHashes() - 1).GetReceiverVK())
+		consumers[recvVK] = append(consumers[recvVK], dchain)
+	}
+	return consumers, nil
+}
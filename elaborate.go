@@ -0,0 +1,100 @@
+package bw2util
+
+import (
+	"fmt"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/pkg/errors"
+)
+
+// Returned (wrapped) by the functions that need the DOTs of a chain when it only carries their hashes.
+// Client.ElaborateChain fills them in
+var ErrNotElaborated = errors.New("chain is not elaborated")
+
+func notElaborated(dchain *objects.DChain) error {
+	return errors.Wrapf(ErrNotElaborated, "Chain %s", fmtHash(dchain.GetChainHash()))
+}
+
+// Returns the chain with all of its DOTs populated, looking up in the registry any that are missing.
+// A chain that is already elaborated is returned as is
+func (c *Client) ElaborateChain(dchain *objects.DChain) (*objects.DChain, error) {
+	elaborated := true
+	for i := 0; i < dchain.NumHashes(); i++ {
+		if dchain.GetDOT(i) == nil {
+			elaborated = false
+			break
+		}
+	}
+	if elaborated {
+		return dchain, nil
+	}
+	dots := make([]*objects.DOT, dchain.NumHashes())
+	for i := range dots {
+		if dots[i] = dchain.GetDOT(i); dots[i] != nil {
+			continue
+		}
+		dot, err := c.resolveDOT(dchain.GetDotHash(i))
+		if err != nil {
+			return nil, err
+		}
+		dots[i] = dot
+	}
+	built, err := objects.CreateDChain(dchain.IsAccess(), dots...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not build chain from DOTs %s", dotHashes(dots))
+	}
+	return built, nil
+}
+
+// Same as GetDChainURIErr, but the chain doesn't need to be elaborated: missing DOTs are looked up with
+// ElaborateChain first
+func (c *Client) ResolveDChainURI(dchain *objects.DChain, uri string) (string, error) {
+	dchain, err := c.ElaborateChain(dchain)
+	if err != nil {
+		return "", err
+	}
+	return GetDChainURIErr(dchain, uri)
+}
+
+// Rebuilds a chain from the hashes of its DOTs in order, e.g. as saved from ChainInfo, by looking each
+// of them up in the registry. Each DOT must be given to the VK that gives the next one, and all of their
+// signatures must be valid
+func (c *Client) BuildChainFromHashes(hashes [][]byte) (*objects.DChain, error) {
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("No DOT hashes given")
+	}
+	dots := make([]*objects.DOT, len(hashes))
+	for i, hash := range hashes {
+		dot, err := c.resolveDOT(hash)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && fmtHash(dots[i-1].GetReceiverVK()) != fmtHash(dot.GetGiverVK()) {
+			return nil, fmt.Errorf("DOT %s is given by %s, but DOT %s was given to %s", fmtHash(hash),
+				fmtHash(dot.GetGiverVK()), fmtHash(hashes[i-1]), fmtHash(dots[i-1].GetReceiverVK()))
+		}
+		dots[i] = dot
+	}
+	dchain, err := objects.CreateDChain(dots[0].IsAccess(), dots...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not build chain from DOTs %s", dotHashes(dots))
+	}
+	if !dchain.CheckAllSigs() {
+		return nil, fmt.Errorf("Chain of DOTs %s has an invalid signature", dotHashes(dots))
+	}
+	return dchain, nil
+}
+
+// looks up a DOT in the registry by its hash
+func (c *Client) resolveDOT(hash []byte) (*objects.DOT, error) {
+	key := fmtHash(hash)
+	ro, _, err := c.bw.ResolveRegistry(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not resolve DOT %s", key)
+	}
+	dot, ok := ro.(*objects.DOT)
+	if !ok {
+		return nil, fmt.Errorf("DOT %s resolved to %T, not a DOT", key, ro)
+	}
+	return dot, nil
+}
@@ -0,0 +1,35 @@
+package bw2util
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestUnelaboratedChainURI(t *testing.T) {
+	w := newTestWorld(t)
+	a := newEntity()
+	dchain := testChain(t, w.bw.grant(w.ns, a, w.ns, "a/*", "C"), w.bw.grant(a, w.me, w.ns, "*", "C"))
+	bare := hashOnly(t, dchain)
+
+	if uri := GetDChainURI(bare, "test.ns/*"); uri != "" {
+		t.Errorf("GetDChainURI = %q for an unelaborated chain, want \"\"", uri)
+	}
+	if _, err := GetDChainURIErr(bare, "test.ns/*"); errors.Cause(err) != ErrNotElaborated {
+		t.Errorf("GetDChainURIErr: got %v, want %v", err, ErrNotElaborated)
+	}
+	if _, ok := GetDChainURISuffix(bare, "test.ns/*"); ok {
+		t.Errorf("GetDChainURISuffix overlaps for an unelaborated chain")
+	}
+
+	uri, err := w.c.ResolveDChainURI(bare, "test.ns/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != "test.ns/a/*" {
+		t.Errorf("ResolveDChainURI = %s, want test.ns/a/*", uri)
+	}
+	if len(w.bw.resolves) != 2 {
+		t.Errorf("resolved %d DOTs, want 2", len(w.bw.resolves))
+	}
+}
@@ -0,0 +1,154 @@
+package bw2util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	bw2 "github.com/immesys/bw2bind"
+	"github.com/pkg/errors"
+)
+
+// records what the chain search threw away, for ExplainAccess. All methods are no-ops on a nil trace,
+// so the search can call them unconditionally, and they are safe for concurrent use since lookups run in
+// parallel
+type searchTrace struct {
+	sync.Mutex
+	// DOTs not followed, by reason
+	skipped map[string]int
+	// complete chains thrown away, by reason
+	discarded map[string]int
+	// VKs whose DOTs led nowhere
+	deadEnds []string
+}
+
+func newSearchTrace() *searchTrace {
+	return &searchTrace{
+		skipped:   make(map[string]int),
+		discarded: make(map[string]int),
+	}
+}
+
+func (t *searchTrace) skip(reason string) {
+	if t != nil {
+		t.Lock()
+		t.skipped[reason]++
+		t.Unlock()
+	}
+}
+
+func (t *searchTrace) discard(reason string) {
+	if t != nil {
+		t.Lock()
+		t.discarded[reason]++
+		t.Unlock()
+	}
+}
+
+func (t *searchTrace) deadEnd(vk string) {
+	if t != nil {
+		t.Lock()
+		t.deadEnds = append(t.deadEnds, vk)
+		t.Unlock()
+	}
+}
+
+// writes the counts in a map in a stable order
+func writeCounts(buf *bytes.Buffer, counts map[string]int) {
+	var reasons []string
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(buf, "  %d: %s\n", counts[reason], reason)
+	}
+}
+
+// Runs the same discovery as MultiSubscribe and returns a human-readable report of what it found: the
+// namespace VK, the DOTs granted from the namespace, where the search dead-ended, which chains were
+// thrown away and why, the effective URI of each usable chain, and which chains MultiSubscribe would
+// subscribe on or skip because they don't overlap the URI. Use this when MultiSubscribe returns an
+// error or delivers nothing
+func (c *Client) ExplainAccess(uri string) (string, error) {
+	var buf bytes.Buffer
+	nsvk, err := c.GetNamespaceVK(uri)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not resolve namespace")
+	}
+	fmt.Fprintf(&buf, "URI %s has namespace VK %s\n", uri, nsvk)
+	fmt.Fprintf(&buf, "Looking for chains to %s\n", c.vk)
+	if c.ownsNamespace(nsvk) {
+		fmt.Fprintf(&buf, "We own the namespace, so MultiSubscribe would subscribe on %s without a chain\n", uri)
+		return buf.String(), nil
+	}
+
+	// count the DOTs from the namespace before and after our own filtering
+	ros, valids, err := c.bw.FindDOTsFromVK(nsvk)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not find DOTS from vk")
+	}
+	valid := 0
+	for _, v := range valids {
+		if v == bw2.StateValid {
+			valid++
+		}
+	}
+	usable, err := c.findDOTsFromVK(context.Background(), nsvk, canConsume, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not find DOTS from vk")
+	}
+	fmt.Fprintf(&buf, "The namespace has granted %d DOTs: %d valid in the registry, %d usable consume DOTs that don't expire within %s\n",
+		len(ros), valid, len(usable), c.ExpiryGrace)
+
+	trace := newSearchTrace()
+	dchains, err := c.buildChains(context.Background(), nsvk, c.vk, nsvk, canConsume, trace)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not find DOT chains")
+	}
+	if len(trace.skipped) > 0 {
+		fmt.Fprintf(&buf, "DOTs not followed:\n")
+		writeCounts(&buf, trace.skipped)
+	}
+	if len(trace.deadEnds) > 0 {
+		fmt.Fprintf(&buf, "The search dead-ended at %d VKs with no usable DOTs onward:\n", len(trace.deadEnds))
+		for _, vk := range trace.deadEnds {
+			fmt.Fprintf(&buf, "  %s\n", vk)
+		}
+	}
+	if len(trace.discarded) > 0 {
+		fmt.Fprintf(&buf, "Chains discarded:\n")
+		writeCounts(&buf, trace.discarded)
+	}
+
+	fmt.Fprintf(&buf, "Found %d valid chains\n", len(dchains))
+	for _, dchain := range dchains {
+		hash := fmtHash(dchain.GetChainHash())
+		if dchain.GetTTL() < 0 {
+			fmt.Fprintf(&buf, "  %s: TTL exceeded\n", hash)
+			continue
+		}
+		if suburi, err := GetDChainURIErr(dchain, uri); err != nil {
+			fmt.Fprintf(&buf, "  %s: %v\n", hash, err)
+		} else {
+			fmt.Fprintf(&buf, "  %s: grants %s\n", hash, suburi)
+		}
+	}
+
+	// what MultiSubscribe would do with them
+	picked, uris, skipped := c.pickChains(dchains, uri, canConsume, nil, nil)
+	fmt.Fprintf(&buf, "MultiSubscribe would subscribe on %d chains\n", len(picked))
+	for i, dchain := range picked {
+		fmt.Fprintf(&buf, "  %s: %s\n", fmtHash(dchain.GetChainHash()), uris[i])
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(&buf, "and skip %d chains that don't overlap %s\n", len(skipped), uri)
+		for _, dchain := range skipped {
+			_, err := GetDChainURIErr(dchain, uri)
+			fmt.Fprintf(&buf, "  %s: %v\n", fmtHash(dchain.GetChainHash()), err)
+		}
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,47 @@
+package bw2util
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/objects"
+)
+
+func TestExplainAccessReportsSkippedChains(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "a/*", "C")
+	w.bw.grant(w.ns, w.me, w.ns, "b/*", "C")
+	report, err := w.c.ExplainAccess("test.ns/a/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"MultiSubscribe would subscribe on 1 chains", "test.ns/a/x", "skip 1 chains that don't overlap"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not mention %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestExplainAccessReportsExpiredDOTs(t *testing.T) {
+	w := newTestWorld(t)
+	a := newEntity()
+	w.bw.grant(w.ns, a, w.ns, "*", "C")
+	expired := objects.CreateDOT(true, a.GetVK(), w.me.GetVK())
+	expired.SetAccessURI(w.ns.GetVK(), "*")
+	expired.SetCanConsume(true, true, true)
+	expired.SetTTL(DefaultMaxChainLength)
+	expired.SetExpiry(time.Now().Add(-time.Hour))
+	expired.Encode(a.GetSK())
+	w.bw.add(expired)
+
+	report, err := w.c.ExplainAccess("test.ns/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1: expired or expiring within ExpiryGrace", "Found 0 valid chains"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not mention %q:\n%s", want, report)
+		}
+	}
+}
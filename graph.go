@@ -0,0 +1,205 @@
+package bw2util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/immesys/bw2/objects"
+)
+
+// The access DOTs on a namespace that are reachable from the namespace VK, whoever they were granted to
+type AccessGraph struct {
+	// the namespace VK the graph starts from
+	Namespace string
+	// every VK in the graph, including the namespace, sorted
+	Nodes []string
+	// one edge for each DOT, in the order they were found
+	Edges []AccessEdge
+}
+
+// An access DOT in an AccessGraph
+type AccessEdge struct {
+	// the giver and receiver VKs
+	From string
+	To   string
+	DOT  *objects.DOT
+	// the URI suffix the DOT grants access on
+	URISuffix   string
+	Permissions *objects.AccessDOTPermissionSet
+}
+
+// every valid access DOT, whatever it grants
+var anyAccess = accessFilter("access", func(*objects.AccessDOTPermissionSet) bool {
+	return true
+})
+
+// Builds the graph of all valid access DOTs on the namespace that can be reached from the namespace VK.
+// Unlike FindDOTChains, the search doesn't stop at our VK and isn't limited by MaxChainLength, since
+// every VK is only expanded once
+func (c *Client) BuildAccessGraph(namespace string) (*AccessGraph, error) {
+	namespace = canonicalVK(namespace)
+	graph := &AccessGraph{Namespace: namespace}
+	var (
+		seenVKs  = map[string]struct{}{namespace: {}}
+		seenDOTs = make(map[string]struct{})
+		frontier = []searchState{{vk: namespace}}
+	)
+	for len(frontier) > 0 {
+		dotsets, err := c.expandFrontier(context.Background(), frontier, anyAccess, make(map[string][]*objects.DOT), nil)
+		if err != nil {
+			return nil, err
+		}
+		var next []searchState
+		for _, dots := range dotsets {
+			for _, dot := range dots {
+				atomic.AddInt64(&c.Metrics.DOTsExamined, 1)
+				if fmtHash(dot.GetAccessURIMVK()) != namespace {
+					continue
+				}
+				hash := fmtHash(dot.GetHash())
+				if _, found := seenDOTs[hash]; found {
+					continue
+				}
+				seenDOTs[hash] = struct{}{}
+				edge := AccessEdge{
+					From:        fmtHash(dot.GetGiverVK()),
+					To:          fmtHash(dot.GetReceiverVK()),
+					DOT:         dot,
+					URISuffix:   dot.GetAccessURISuffix(),
+					Permissions: dot.GetPermissionSet(),
+				}
+				graph.Edges = append(graph.Edges, edge)
+				if _, found := seenVKs[edge.To]; !found {
+					seenVKs[edge.To] = struct{}{}
+					next = append(next, searchState{vk: edge.To})
+				}
+			}
+		}
+		frontier = next
+	}
+	for vk := range seenVKs {
+		graph.Nodes = append(graph.Nodes, vk)
+	}
+	sort.Strings(graph.Nodes)
+	return graph, nil
+}
+
+// Renders the graph in the Graphviz DOT language. Each edge is labelled with its URI suffix and its
+// permissions, e.g. "a/b/* (C*P)"
+func (g *AccessGraph) Graphviz() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph access {\n")
+	for _, vk := range g.Nodes {
+		label := vk
+		if vk == g.Namespace {
+			label = "namespace\\n" + vk
+		} else if vk == EVERYBODYVK {
+			label = "everybody"
+		}
+		fmt.Fprintf(&buf, "\t%q [label=%q];\n", vk, label)
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&buf, "\t%q -> %q [label=%q];\n", edge.From, edge.To,
+			fmt.Sprintf("%s (%s)", edge.URISuffix, permString(edge.Permissions)))
+	}
+	fmt.Fprintf(&buf, "}\n")
+	return buf.String()
+}
+
+// the short form of an access permission set, e.g. "C*P"
+func permString(p *objects.AccessDOTPermissionSet) string {
+	if p == nil {
+		return ""
+	}
+	var parts []string
+	switch {
+	case p.CanConsumeStar:
+		parts = append(parts, "C*")
+	case p.CanConsumePlus:
+		parts = append(parts, "C+")
+	case p.CanConsume:
+		parts = append(parts, "C")
+	}
+	switch {
+	case p.CanTapStar:
+		parts = append(parts, "T*")
+	case p.CanTapPlus:
+		parts = append(parts, "T+")
+	case p.CanTap:
+		parts = append(parts, "T")
+	}
+	if p.CanPublish {
+		parts = append(parts, "P")
+	}
+	if p.CanList {
+		parts = append(parts, "L")
+	}
+	return strings.Join(parts, "")
+}
+
+// What changed between two AccessGraphs, from DiffAccessGraphs
+type AccessGraphDiff struct {
+	// VKs only in the later graph, and only in the earlier one, sorted
+	AddedVKs   []string
+	RemovedVKs []string
+	// edges whose DOT is only in the later graph, and only in the earlier one, in the order of their graphs
+	AddedDOTs   []AccessEdge
+	RemovedDOTs []AccessEdge
+}
+
+// Returns true if the graphs are the same
+func (d AccessGraphDiff) Empty() bool {
+	return len(d.AddedVKs) == 0 && len(d.RemovedVKs) == 0 && len(d.AddedDOTs) == 0 && len(d.RemovedDOTs) == 0
+}
+
+// Compares two snapshots of an access graph, e.g. from BuildAccessGraph at different times. DOTs are
+// matched by hash. Either graph may be nil, which is the same as an empty graph
+func DiffAccessGraphs(before, after *AccessGraph) AccessGraphDiff {
+	if before == nil {
+		before = &AccessGraph{}
+	}
+	if after == nil {
+		after = &AccessGraph{}
+	}
+	var diff AccessGraphDiff
+	diff.AddedVKs = subtractVKs(after.Nodes, before.Nodes)
+	diff.RemovedVKs = subtractVKs(before.Nodes, after.Nodes)
+	diff.AddedDOTs = subtractEdges(after.Edges, before.Edges)
+	diff.RemovedDOTs = subtractEdges(before.Edges, after.Edges)
+	return diff
+}
+
+// the VKs in a that aren't in b, sorted
+func subtractVKs(a, b []string) []string {
+	inB := make(map[string]struct{}, len(b))
+	for _, vk := range b {
+		inB[vk] = struct{}{}
+	}
+	var ret []string
+	for _, vk := range a {
+		if _, found := inB[vk]; !found {
+			ret = append(ret, vk)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// the edges in a whose DOT isn't in b
+func subtractEdges(a, b []AccessEdge) []AccessEdge {
+	inB := make(map[string]struct{}, len(b))
+	for _, edge := range b {
+		inB[fmtHash(edge.DOT.GetHash())] = struct{}{}
+	}
+	var ret []AccessEdge
+	for _, edge := range a {
+		if _, found := inB[fmtHash(edge.DOT.GetHash())]; !found {
+			ret = append(ret, edge)
+		}
+	}
+	return ret
+}
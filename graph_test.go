@@ -0,0 +1,73 @@
+package bw2util
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/immesys/bw2/objects"
+)
+
+func TestBuildAccessGraph(t *testing.T) {
+	w := newTestWorld(t)
+	a, b := newEntity(), newEntity()
+	other := newEntity()
+	w.bw.grant(w.ns, a, w.ns, "*", "C")
+	w.bw.grant(a, b, w.ns, "x/*", "P")
+	w.bw.grant(b, a, w.ns, "*", "C")
+	// granted on another namespace, so not part of this graph
+	w.bw.grant(w.ns, w.me, other, "*", "C")
+
+	graph, err := w.c.BuildAccessGraph(vkOf(w.ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sortedCopy([]string{vkOf(w.ns), vkOf(a), vkOf(b)}); !reflect.DeepEqual(graph.Nodes, want) {
+		t.Errorf("got nodes %v, want %v", graph.Nodes, want)
+	}
+	if len(graph.Edges) != 3 {
+		t.Fatalf("got %d edges, want 3", len(graph.Edges))
+	}
+	if edge := graph.Edges[1]; edge.From != vkOf(a) || edge.To != vkOf(b) || edge.URISuffix != "x/*" || !edge.Permissions.CanPublish {
+		t.Errorf("got edge %+v, want a -> b publishing on x/*", edge)
+	}
+}
+
+func TestDiffAccessGraphs(t *testing.T) {
+	w := newTestWorld(t)
+	a, b := newEntity(), newEntity()
+	edge := func(dot *objects.DOT) AccessEdge {
+		return AccessEdge{From: fmtHash(dot.GetGiverVK()), To: fmtHash(dot.GetReceiverVK()), DOT: dot}
+	}
+	toA := edge(w.bw.grant(w.ns, a, w.ns, "*", "C"))
+	toB := edge(w.bw.grant(w.ns, b, w.ns, "*", "C"))
+	aToB := edge(w.bw.grant(a, b, w.ns, "*", "C"))
+	ns, vkA, vkB := vkOf(w.ns), vkOf(a), vkOf(b)
+	graph := func(nodes []string, edges ...AccessEdge) *AccessGraph {
+		return &AccessGraph{Namespace: ns, Nodes: sortedCopy(nodes), Edges: edges}
+	}
+	g1 := graph([]string{ns, vkA}, toA)
+	g2 := graph([]string{ns, vkA, vkB}, toA, toB, aToB)
+	g3 := graph([]string{ns, vkB}, toB)
+
+	for _, tc := range []struct {
+		name          string
+		before, after *AccessGraph
+		want          AccessGraphDiff
+	}{
+		{"both nil", nil, nil, AccessGraphDiff{}},
+		{"same graph", g2, g2, AccessGraphDiff{}},
+		{"from nil", nil, g1, AccessGraphDiff{AddedVKs: g1.Nodes, AddedDOTs: []AccessEdge{toA}}},
+		{"to nil", g1, nil, AccessGraphDiff{RemovedVKs: g1.Nodes, RemovedDOTs: []AccessEdge{toA}}},
+		{"grown", g1, g2, AccessGraphDiff{AddedVKs: []string{vkB}, AddedDOTs: []AccessEdge{toB, aToB}}},
+		{"shrunk", g2, g1, AccessGraphDiff{RemovedVKs: []string{vkB}, RemovedDOTs: []AccessEdge{toB, aToB}}},
+		{"replaced", g1, g3, AccessGraphDiff{AddedVKs: []string{vkB}, RemovedVKs: []string{vkA}, AddedDOTs: []AccessEdge{toB}, RemovedDOTs: []AccessEdge{toA}}},
+	} {
+		got := DiffAccessGraphs(tc.before, tc.after)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+		if got.Empty() != tc.want.Empty() {
+			t.Errorf("%s: Empty() = %v", tc.name, got.Empty())
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package bw2util
+
+import (
+	"sync"
+
+	bw2 "github.com/immesys/bw2bind"
+)
+
+// Fans the channels (e.g. from several MultiSubscribe calls) into one. The returned channel is closed
+// once all of the inputs are closed, or straight away if there are none. It must be drained, or the
+// inputs will back up
+func MergeChannels(chans ...chan *bw2.SimpleMessage) chan *bw2.SimpleMessage {
+	out := make(chan *bw2.SimpleMessage, 10)
+	var wg sync.WaitGroup
+	wg.Add(len(chans))
+	for _, ch := range chans {
+		go func(ch chan *bw2.SimpleMessage) {
+			defer wg.Done()
+			for msg := range ch {
+				out <- msg
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// Same as MergeChannels, for the channels of MultiSubscribeTagged
+func MergeTaggedChannels(chans ...chan *TaggedMessage) chan *TaggedMessage {
+	out := make(chan *TaggedMessage, 10)
+	var wg sync.WaitGroup
+	wg.Add(len(chans))
+	for _, ch := range chans {
+		go func(ch chan *TaggedMessage) {
+			defer wg.Done()
+			for msg := range ch {
+				out <- msg
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
@@ -0,0 +1,61 @@
+package bw2util
+
+import (
+	"sync/atomic"
+)
+
+// Counters for chain discovery and subscription on a Client. All fields are updated atomically;
+// use Snapshot to read them
+type Metrics struct {
+	// DOTs considered while searching for chains
+	DOTsExamined int64
+	// valid chains built by the chain search
+	ChainsFound int64
+	// chains dropped because another chain covers their URI
+	ChainsPruned int64
+	// per-chain subscriptions from MultiSubscribe that are currently open
+	ActiveSubscriptions int64
+}
+
+// Returns a consistent-per-field copy of the counters
+func (m *Metrics) Snapshot() Metrics {
+	return Metrics{
+		DOTsExamined:        atomic.LoadInt64(&m.DOTsExamined),
+		ChainsFound:         atomic.LoadInt64(&m.ChainsFound),
+		ChainsPruned:        atomic.LoadInt64(&m.ChainsPruned),
+		ActiveSubscriptions: atomic.LoadInt64(&m.ActiveSubscriptions),
+	}
+}
+
+// A snapshot of what a Client currently has open, from Status
+type ClientStatus struct {
+	// MultiSubscribe (and variant) calls whose channels are still open
+	Subscriptions int
+	// per-chain subscriptions currently open across all of them
+	ChainSubscriptions int64
+	// entries in the chain cache (see ChainCacheTTL)
+	CachedChainSets int
+	// namespaces resolved by GetNamespaceVK
+	CachedNamespaces int
+	// message signatures remembered for deduplication
+	CachedSignatures int
+	// whether Close has been called
+	Closed bool
+}
+
+// Returns the current status of the client. This is cheap enough to call from a health check
+func (c *Client) Status() ClientStatus {
+	c.subsLock.Lock()
+	status := ClientStatus{
+		Subscriptions: len(c.subs),
+		Closed:        c.closed,
+	}
+	c.subsLock.Unlock()
+	c.nsLock.Lock()
+	status.CachedNamespaces = len(c.nsCache)
+	c.nsLock.Unlock()
+	status.ChainSubscriptions = atomic.LoadInt64(&c.Metrics.ActiveSubscriptions)
+	status.CachedChainSets = c.chainCache.ItemCount()
+	status.CachedSignatures = c.dupCache.ItemCount()
+	return status
+}
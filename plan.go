@@ -0,0 +1,64 @@
+package bw2util
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/immesys/bw2/objects"
+	bw2 "github.com/immesys/bw2bind"
+)
+
+// One of the subscriptions MultiSubscribe would make
+type SubscriptionPlan struct {
+	// the chain the subscription would be made on; nil in a namespace we own
+	Chain *objects.DChain
+	// the effective URI of the subscription, from GetDChainURI
+	URI string
+	// the permissions the chain grants, from ChainPermissions
+	Permissions *objects.AccessDOTPermissionSet
+}
+
+// Does the discovery MultiSubscribe would do for the URI and returns the subscriptions it would make,
+// without subscribing. Pass the plan to ExecutePlan to subscribe
+func (c *Client) MultiSubscribePlan(uri string) ([]SubscriptionPlan, error) {
+	if err := ValidateURI(uri); err != nil {
+		return nil, err
+	}
+	dchains, uris, _, err := c.usableChains(context.Background(), uri, canConsume, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]SubscriptionPlan, len(dchains))
+	for i, dchain := range dchains {
+		plans[i] = SubscriptionPlan{Chain: dchain, URI: uris[i]}
+		if dchain == nil {
+			plans[i].Permissions = allPermissions()
+			continue
+		}
+		// chains from usableChains are elaborated access chains, so this can't fail
+		plans[i].Permissions, _ = ChainPermissions(dchain)
+	}
+	return plans, nil
+}
+
+// Subscribes to (and queries) each entry of a plan from MultiSubscribePlan, merging the messages into
+// one channel as MultiSubscribeWithParams does. params.URI should be the URI the plan was made for, and
+// the rest of params applies as usual, except that Selector, VKFilter and Mode are ignored because the
+// plan already fixes the chains. Chains that have expired since the plan was made will fail like any
+// other chain
+func (c *Client) ExecutePlan(ctx context.Context, params *MultiSubscribeParams, plans []SubscriptionPlan) (chan *bw2.SimpleMessage, error) {
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("Subscription plan is empty")
+	}
+	dchains := make([]*objects.DChain, len(plans))
+	uris := make([]string, len(plans))
+	for i, plan := range plans {
+		dchains[i] = plan.Chain
+		uris[i] = plan.URI
+	}
+	sub, err := c.subscribeChains(ctx, params, dchains, uris, nil)
+	if err != nil {
+		return nil, err
+	}
+	return untag(sub.stop, sub.msgs), nil
+}
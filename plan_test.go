@@ -0,0 +1,41 @@
+package bw2util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	bw2 "github.com/immesys/bw2bind"
+)
+
+func TestExecutePlan(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "a/*", "C")
+	plans, err := w.c.MultiSubscribePlan("test.ns/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 1 || plans[0].URI != "test.ns/a/*" {
+		t.Fatalf("got plans %+v, want one on test.ns/a/*", plans)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	expiry := time.Now().Add(time.Hour)
+	params := &MultiSubscribeParams{
+		URI:       "test.ns/*",
+		SkipQuery: true,
+		Template:  &bw2.SubscribeParams{Expiry: &expiry},
+	}
+	msgs, err := w.c.ExecutePlan(ctx, params, plans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	drain(t, msgs)
+	if len(w.bw.queries) != 0 {
+		t.Fatalf("SkipQuery was ignored: %d queries made", len(w.bw.queries))
+	}
+	if len(w.bw.subscribes) != 1 || w.bw.subscribes[0].Expiry != &expiry {
+		t.Fatal("the subscription was not made from the template")
+	}
+}
@@ -0,0 +1,128 @@
+package bw2util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/immesys/bw2/objects"
+	bw2 "github.com/immesys/bw2bind"
+	"github.com/pkg/errors"
+)
+
+// The publish analog of MultiSubscribe: my publish access to some broad URI may be split across several
+// DOT chains, so we find all chains from the namespace VK of the URI to our VK that grant publish permissions,
+// and publish the payload object once on the effective URI of each chain (modulo any overlaps, see PruneRedundantChains).
+// If some of the publishes fail, the returned error is a MultiError containing a *ChainError for each of them
+func (c *Client) MultiPublish(uri string, po bw2.PayloadObject) error {
+	if err := validatePublish(uri, po); err != nil {
+		return err
+	}
+	dchains, uris, _, err := c.usableChains(context.Background(), uri, canPublish, nil, nil)
+	if err != nil {
+		return err
+	}
+	if len(dchains) == 0 {
+		return fmt.Errorf("No chains grant publish on %s", uri)
+	}
+
+	var errs MultiError
+	for i, dchain := range dchains {
+		puburi := uris[i]
+		err := c.bw.Publish(&bw2.PublishParams{
+			URI:            puburi,
+			AutoChain:      false,
+			RoutingObjects: routingObjects(dchain),
+			ElaboratePAC:   bw2.ElaboratePartial,
+			PayloadObjects: []bw2.PayloadObject{po},
+		})
+		if err != nil {
+			errs = append(errs, &ChainError{Chain: dchain, URI: puburi, Op: "publish", Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checks the arguments of the publish helpers before anything is sent to the agent
+func validatePublish(uri string, po bw2.PayloadObject) error {
+	if strings.TrimSpace(uri) == "" {
+		return fmt.Errorf("Cannot publish on an empty URI")
+	}
+	if err := ValidateURI(uri); err != nil {
+		return errors.Wrap(err, "Cannot publish")
+	}
+	if po == nil {
+		return fmt.Errorf("Cannot publish a nil PayloadObject on %s", uri)
+	}
+	return nil
+}
+
+// Returns the best chain granting publish on the URI, suitable for passing as a routing object to
+// Publish with ElaboratePartial. Only chains that cover the whole URI (i.e. GetDChainURI doesn't narrow
+// it) are considered; of those the shortest is used, preferring the one that expires last on ties. If the
+// namespace is ours, no chain is needed and the chain returned is nil
+func (c *Client) BuildPublishChain(uri string) (*objects.DChain, error) {
+	nsvk, err := c.GetNamespaceVK(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not resolve namespace")
+	}
+	if c.ownsNamespace(nsvk) {
+		return nil, nil
+	}
+	dchains, err := c.findChains(context.Background(), nsvk, canPublish)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not find DOT chains")
+	}
+
+	var covering []*objects.DChain
+	for _, dchain := range liveChains(dchains, canPublish) {
+		if GetDChainURI(dchain, uri) == uri {
+			covering = append(covering, dchain)
+		}
+	}
+	if len(covering) == 0 {
+		return nil, fmt.Errorf("No chains grant publish on all of %s", uri)
+	}
+
+	return bestChain(covering), nil
+}
+
+// returns the shortest of the chains, preferring the one that expires last on ties
+func bestChain(dchains []*objects.DChain) *objects.DChain {
+	best := dchains[0]
+	for _, dchain := range dchains[1:] {
+		if dchain.NumHashes() < best.NumHashes() {
+			best = dchain
+		} else if dchain.NumHashes() == best.NumHashes() && LongestLivedChain([]*objects.DChain{best, dchain})[0] != best {
+			best = dchain
+		}
+	}
+	return best
+}
+
+// Publishes the payload object once on the URI, using the chain from BuildPublishChain, and returns
+// the chain that was used, which is nil in a namespace we own. Unlike MultiPublish, this fails if no
+// single chain grants publish on all of the URI
+func (c *Client) PublishOnBestChain(uri string, po bw2.PayloadObject) (*objects.DChain, error) {
+	if err := validatePublish(uri, po); err != nil {
+		return nil, err
+	}
+	dchain, err := c.BuildPublishChain(uri)
+	if err != nil {
+		return nil, err
+	}
+	err = c.bw.Publish(&bw2.PublishParams{
+		URI:            uri,
+		AutoChain:      false,
+		RoutingObjects: routingObjects(dchain),
+		ElaboratePAC:   bw2.ElaboratePartial,
+		PayloadObjects: []bw2.PayloadObject{po},
+	})
+	if err != nil {
+		return nil, &ChainError{Chain: dchain, URI: uri, Op: "publish", Err: err}
+	}
+	return dchain, nil
+}
@@ -0,0 +1,39 @@
+package bw2util
+
+import (
+	"testing"
+
+	bw2 "github.com/immesys/bw2bind"
+)
+
+func TestValidatePublish(t *testing.T) {
+	po := testPO{ponum: 1}
+	for _, tc := range []struct {
+		name string
+		uri  string
+		po   bw2.PayloadObject
+	}{
+		{"empty URI", "", po},
+		{"whitespace URI", "  \t", po},
+		{"invalid URI", "test.ns//a", po},
+		{"nil PayloadObject", "test.ns/a", nil},
+	} {
+		w := newTestWorld(t)
+		w.bw.grant(w.ns, w.me, w.ns, "*", "CP")
+		if err := validatePublish(tc.uri, tc.po); err == nil {
+			t.Errorf("%s: validatePublish accepted it", tc.name)
+		}
+		if err := w.c.MultiPublish(tc.uri, tc.po); err == nil {
+			t.Errorf("%s: MultiPublish accepted it", tc.name)
+		}
+		if _, err := w.c.PublishOnBestChain(tc.uri, tc.po); err == nil {
+			t.Errorf("%s: PublishOnBestChain accepted it", tc.name)
+		}
+		if len(w.bw.resolves) != 0 || len(w.bw.publishes) != 0 {
+			t.Errorf("%s: made %d agent calls, want none", tc.name, len(w.bw.resolves)+len(w.bw.publishes))
+		}
+	}
+	if err := validatePublish("test.ns/a", po); err != nil {
+		t.Errorf("validatePublish rejected a valid publish: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package bw2util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/immesys/bw2/objects"
+	bw2 "github.com/immesys/bw2bind"
+	"github.com/pkg/errors"
+)
+
+// A message along with the chain it was received through
+type TaggedMessage struct {
+	Msg *bw2.SimpleMessage
+	// the chain used to receive the message; nil if it came from a namespace we own
+	Chain *objects.DChain
+	// the effective URI of the subscription or query on that chain
+	URI string
+}
+
+// Runs a one-shot query for the URI on every chain we can use to consume it (see MultiSubscribe)
+// and returns the results once all of the queries are done. A message returned by several chains
+// is only included once, tagged with the first of those chains in the order they were found. If any of the queries fail,
+// the results from the others are returned along with a MultiError of *ChainError
+func (c *Client) MultiQuery(uri string) ([]*TaggedMessage, error) {
+	return c.MultiQueryWithParams(&MultiQueryParams{URI: uri})
+}
+
+// Extra options for MultiQueryWithParams. The zero value (apart from URI) behaves like MultiQuery
+type MultiQueryParams struct {
+	// the URI to query
+	URI string
+	// picks which of the usable chains to query on; AllChains if nil
+	Selector ChainSelector
+	// if non-nil, only chains that pass (or avoid) its VK are considered
+	VKFilter *VKFilter
+	// how the query on each chain is retried if it fails. Only the last error is returned. By default
+	// each query is tried once
+	Retry RetryPolicy
+}
+
+// Same as MultiQuery, but with the extra options in MultiQueryParams
+func (c *Client) MultiQueryWithParams(params *MultiQueryParams) ([]*TaggedMessage, error) {
+	results, errs, err := c.queryChains(params)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		tagged []*TaggedMessage
+		// dedup by signature within this query only, so we don't interfere with subscriptions
+		seen = make(map[string]struct{})
+	)
+	for _, result := range results {
+		for _, msg := range result.Msgs {
+			if _, found := seen[string(msg.Signature)]; !found {
+				seen[string(msg.Signature)] = struct{}{}
+				tagged = append(tagged, &TaggedMessage{Msg: msg, Chain: result.Chain, URI: result.URI})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return tagged, errs
+	}
+	return tagged, nil
+}
+
+// The messages a query on one chain returned
+type QueryResult struct {
+	// the chain queried on; nil in a namespace we own
+	Chain *objects.DChain
+	// the effective URI of the query on that chain
+	URI string
+	// the messages returned, each only once
+	Msgs []*bw2.SimpleMessage
+}
+
+// Same as MultiQuery, but keeps the messages from each chain apart: there is one QueryResult for each
+// chain, in the order of the chains, holding the messages returned through it. Messages are only
+// deduplicated within each result, so a message visible through several chains is in each of their
+// results. If any of the queries fail, their results are left out and a MultiError of *ChainError is
+// returned along with the rest
+func (c *Client) MultiQueryGrouped(uri string) ([]QueryResult, error) {
+	return c.MultiQueryGroupedWithParams(&MultiQueryParams{URI: uri})
+}
+
+// Same as MultiQueryGrouped, but with the extra options in MultiQueryParams
+func (c *Client) MultiQueryGroupedWithParams(params *MultiQueryParams) ([]QueryResult, error) {
+	results, errs, err := c.queryChains(params)
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// Counts the persisted messages each chain we can consume the URI with gives access to, by running a
+// one-shot query on every chain. The map goes from the effective URI of each chain (see GetDChainURI)
+// to the number of messages its query returned. Messages are counted once per chain, so a message
+// visible through several chains is counted for each. If any of the queries fail, the counts from the
+// others are returned along with a MultiError of *ChainError
+func (c *Client) CountPersisted(uri string) (map[string]int, error) {
+	return c.CountPersistedWithParams(&MultiQueryParams{URI: uri})
+}
+
+// Same as CountPersisted, but with the extra options in MultiQueryParams
+func (c *Client) CountPersistedWithParams(params *MultiQueryParams) (map[string]int, error) {
+	results, errs, err := c.queryChains(params)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.URI] += len(result.Msgs)
+	}
+	if len(errs) > 0 {
+		return counts, errs
+	}
+	return counts, nil
+}
+
+// does the work for the MultiQuery variants: queries on each chain the params pick, concurrently, and
+// returns the results of the queries that succeeded in the order of the chains, each deduplicated by
+// signature. The queries that failed are returned as *ChainError in the MultiError. The error is only
+// set if the chains couldn't be found
+func (c *Client) queryChains(params *MultiQueryParams) ([]QueryResult, MultiError, error) {
+	dchains, uris, _, err := c.usableChains(context.Background(), params.URI, canConsume, params.VKFilter, params.Selector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		results = make([]QueryResult, len(dchains))
+		failed  = make([]bool, len(dchains))
+		errs    MultiError
+	)
+	wg.Add(len(dchains))
+	for i, dchain := range dchains {
+		go func(i int, uri string, dchain *objects.DChain) {
+			defer wg.Done()
+			var msgs chan *bw2.SimpleMessage
+			err := params.Retry.do(context.Background(), func() (err error) {
+				msgs, err = c.query(&bw2.QueryParams{
+					URI:            uri,
+					AutoChain:      false,
+					RoutingObjects: routingObjects(dchain),
+					ElaboratePAC:   bw2.ElaboratePartial,
+				})
+				return err
+			})
+			if err != nil {
+				lock.Lock()
+				errs = append(errs, &ChainError{Chain: dchain, URI: uri, Op: "query", Err: err})
+				failed[i] = true
+				lock.Unlock()
+				return
+			}
+			// each goroutine only touches its own result
+			result := QueryResult{Chain: dchain, URI: uri}
+			seen := make(map[string]struct{})
+			for msg := range msgs {
+				if _, found := seen[string(msg.Signature)]; !found {
+					seen[string(msg.Signature)] = struct{}{}
+					result.Msgs = append(result.Msgs, msg)
+				}
+			}
+			results[i] = result
+		}(i, uris[i], dchain)
+	}
+	wg.Wait()
+
+	var ok []QueryResult
+	for i, result := range results {
+		if !failed[i] {
+			ok = append(ok, result)
+		}
+	}
+	return ok, errs, nil
+}
+
+// Returns a single chain granting consume on all of every one of the URIs, so that one chain can be
+// used for all of them. The URIs must be in the same namespace. Of the chains that qualify, the
+// shortest is returned, preferring the one that expires last on ties. If the namespace is ours, no chain
+// is needed and the chain returned is nil
+func (c *Client) FindCommonChain(uris []string) (*objects.DChain, error) {
+	if len(uris) == 0 {
+		return nil, fmt.Errorf("No URIs given")
+	}
+	nsvks, err := c.GetNamespaceVKs(uris)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not resolve namespace")
+	}
+	nsvk := nsvks[uris[0]]
+	for _, uri := range uris[1:] {
+		if nsvks[uri] != nsvk {
+			return nil, fmt.Errorf("URIs %s and %s are in different namespaces", uris[0], uri)
+		}
+	}
+	if c.ownsNamespace(nsvk) {
+		return nil, nil
+	}
+	dchains, err := c.findChains(context.Background(), nsvk, canConsume)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not find DOT chains")
+	}
+
+	var common []*objects.DChain
+	for _, dchain := range liveChains(dchains, canConsume) {
+		covers := true
+		for _, uri := range uris {
+			if GetDChainURI(dchain, uri) != uri {
+				covers = false
+				break
+			}
+		}
+		if covers {
+			common = append(common, dchain)
+		}
+	}
+	if len(common) == 0 {
+		return nil, fmt.Errorf("No chain grants consume on all of %s", strings.Join(uris, ", "))
+	}
+	return bestChain(common), nil
+}
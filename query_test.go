@@ -0,0 +1,86 @@
+package bw2util
+
+import (
+	"testing"
+
+	"github.com/immesys/bw2/objects"
+	bw2 "github.com/immesys/bw2bind"
+	"github.com/pkg/errors"
+)
+
+// a world with two chains on test.ns, on a/* and b/*, that both return the same message
+func newQueryWorld(t *testing.T) *testWorld {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "a/*", "C")
+	w.bw.grant(w.ns, w.me, w.ns, "b/*", "C")
+	msg := testMessage("test.ns/x", "sig", testPO{ponum: 1})
+	w.bw.messages["test.ns/a/*"] = []*bw2.SimpleMessage{msg}
+	w.bw.messages["test.ns/b/*"] = []*bw2.SimpleMessage{msg, msg}
+	return w
+}
+
+func TestMultiQuery(t *testing.T) {
+	w := newQueryWorld(t)
+	tagged, err := w.c.MultiQuery("test.ns/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagged) != 1 {
+		t.Fatalf("got %d messages, want 1", len(tagged))
+	}
+
+	results, err := w.c.MultiQueryGrouped("test.ns/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || len(results[0].Msgs) != 1 || len(results[1].Msgs) != 1 {
+		t.Fatalf("got %+v, want one message from each of two chains", results)
+	}
+	if !ChainsEqual(tagged[0].Chain, results[0].Chain) {
+		t.Errorf("message tagged with chain %s, want the first chain %s", ChainHash(tagged[0].Chain), ChainHash(results[0].Chain))
+	}
+
+	counts, err := w.c.CountPersisted("test.ns/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 || counts["test.ns/a/*"] != 1 || counts["test.ns/b/*"] != 1 {
+		t.Errorf("got counts %v, want 1 on each chain", counts)
+	}
+}
+
+func TestMultiQueryVariantsHonourParams(t *testing.T) {
+	w := newQueryWorld(t)
+	// every query fails once before it succeeds
+	tried := make(map[string]bool)
+	w.bw.queryFn = func(p *bw2.QueryParams) (chan *bw2.SimpleMessage, error) {
+		if !tried[p.URI] {
+			tried[p.URI] = true
+			return nil, errors.New("transient")
+		}
+		msgs := make(chan *bw2.SimpleMessage, len(w.bw.messages[p.URI]))
+		for _, msg := range w.bw.messages[p.URI] {
+			msgs <- msg
+		}
+		close(msgs)
+		return msgs, nil
+	}
+	first := func(dchains []*objects.DChain) []*objects.DChain { return dchains[:1] }
+	params := &MultiQueryParams{URI: "test.ns/*", Selector: first, Retry: RetryPolicy{Attempts: 2}}
+
+	results, err := w.c.MultiQueryGroupedWithParams(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Errorf("got %d results, want 1 from the selected chain", len(results))
+	}
+	tried = make(map[string]bool)
+	counts, err := w.c.CountPersistedWithParams(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 {
+		t.Errorf("got counts %v, want one from the selected chain", counts)
+	}
+}
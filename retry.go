@@ -0,0 +1,34 @@
+package bw2util
+
+import (
+	"context"
+	"time"
+)
+
+// How an agent call is retried when it fails. The zero value makes a single attempt
+type RetryPolicy struct {
+	// how many attempts to make in total; values below 2 mean no retries
+	Attempts int
+	// how long to wait before the first retry. The wait doubles after each retry
+	Backoff time.Duration
+	// reports whether an error is transient and worth retrying. If nil, every error is retried
+	Retryable func(error) bool
+}
+
+// calls fn until it succeeds, the error isn't retryable, the attempts run out, or ctx is done while
+// waiting to retry, and returns the last error
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.Attempts || (p.Retryable != nil && !p.Retryable(err)) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
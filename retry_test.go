@@ -0,0 +1,68 @@
+package bw2util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	failing := errors.New("failing")
+	for _, tc := range []struct {
+		name   string
+		policy RetryPolicy
+		want   int
+	}{
+		{"zero value", RetryPolicy{}, 1},
+		{"retries", RetryPolicy{Attempts: 3}, 3},
+		{"not retryable", RetryPolicy{Attempts: 3, Retryable: func(error) bool { return false }}, 1},
+	} {
+		calls := 0
+		err := tc.policy.do(context.Background(), func() error {
+			calls++
+			return failing
+		})
+		if err != failing || calls != tc.want {
+			t.Errorf("%s: got %d calls and %v, want %d calls and %v", tc.name, calls, err, tc.want, failing)
+		}
+	}
+}
+
+func TestRetryPolicyHonoursContext(t *testing.T) {
+	failing := errors.New("failing")
+	policy := RetryPolicy{Attempts: 3, Backoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	done := make(chan error)
+	go func() {
+		done <- policy.do(ctx, func() error {
+			calls++
+			return failing
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != failing || calls != 1 {
+			t.Errorf("got %d calls and %v, want 1 call and %v", calls, err, failing)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("do kept waiting to retry after the context was cancelled")
+	}
+}
+
+func TestFindDOTChainsHonoursContext(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := w.c.findDOTChains(ctx, vkOf(w.ns), vkOf(w.me), vkOf(w.ns), canConsume, nil, nil); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if len(w.bw.lookups) != 0 {
+		t.Errorf("made %d lookups after the context was cancelled", len(w.bw.lookups))
+	}
+}
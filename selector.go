@@ -0,0 +1,68 @@
+package bw2util
+
+import (
+	"github.com/immesys/bw2/objects"
+)
+
+// Chooses which of the usable chains for a URI MultiSubscribe and MultiQuery should actually use.
+// The chains passed in have already had redundant chains removed (see PruneRedundantChains)
+type ChainSelector func([]*objects.DChain) []*objects.DChain
+
+// Restricts the chains MultiSubscribe and MultiQuery will use to those that pass through a VK, e.g. a
+// trusted authority, or with Exclude to those that don't. Unlike a ChainSelector, this is applied before
+// redundant chains are pruned, so a chain that passes isn't dropped in favour of one that doesn't
+type VKFilter struct {
+	// the VK, in the same encoding as the rest of the package
+	VK      string
+	Exclude bool
+}
+
+// returns true if the chain should be used
+func (f *VKFilter) keep(dchain *objects.DChain) bool {
+	vk := canonicalVK(f.VK)
+	through := false
+	for _, chainVK := range chainVKs(dchain) {
+		if chainVK == vk {
+			through = true
+			break
+		}
+	}
+	return through != f.Exclude
+}
+
+// Uses every chain. This is the default
+func AllChains(chains []*objects.DChain) []*objects.DChain {
+	return chains
+}
+
+// Uses only the chain with the fewest DOTs. Ties go to the earlier chain
+func ShortestChain(chains []*objects.DChain) []*objects.DChain {
+	if len(chains) == 0 {
+		return nil
+	}
+	best := chains[0]
+	for _, dchain := range chains[1:] {
+		if dchain.NumHashes() < best.NumHashes() {
+			best = dchain
+		}
+	}
+	return []*objects.DChain{best}
+}
+
+// Uses only the chain whose earliest-expiring DOT expires last. Chains that never expire win
+func LongestLivedChain(chains []*objects.DChain) []*objects.DChain {
+	if len(chains) == 0 {
+		return nil
+	}
+	best := chains[0]
+	bestExpiry := chainExpiry(best)
+	for _, dchain := range chains[1:] {
+		if bestExpiry == nil {
+			break
+		}
+		if expiry := chainExpiry(dchain); expiry == nil || expiry.After(*bestExpiry) {
+			best, bestExpiry = dchain, expiry
+		}
+	}
+	return []*objects.DChain{best}
+}
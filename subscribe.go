@@ -0,0 +1,141 @@
+package bw2util
+
+import (
+	"context"
+	"time"
+
+	"github.com/immesys/bw2/objects"
+	bw2 "github.com/immesys/bw2bind"
+	"github.com/pkg/errors"
+)
+
+// Reported (inside a *ChainError) when a per-chain subscription or query isn't established within
+// MultiSubscribeParams.StartTimeout
+var ErrStartTimeout = errors.New("timed out waiting for the agent")
+
+// Reported (inside a *ChainError) when the agent closes a per-chain subscription that MultiSubscribeParams.Reconnect
+// will re-establish
+var ErrSubscriptionDropped = errors.New("subscription closed by the agent")
+
+// Reported (inside a *ChainError) for the chains left out because Client.MaxConcurrentSubscriptions
+// subscriptions are already open
+var ErrTooManySubscriptions = errors.New("too many concurrent subscriptions")
+
+// Reported (inside a *ChainError) when the agent accepts a subscription or query but hands back no channel
+var ErrNilChannel = errors.New("agent returned no message channel")
+
+const (
+	DefaultReconnectBackoff    = time.Second
+	DefaultMaxReconnectBackoff = time.Minute
+)
+
+// calls SubscribeH, turning a missing channel into ErrNilChannel so nobody ranges over a nil channel forever
+func (c *Client) subscribe(p *bw2.SubscribeParams) (chan *bw2.SimpleMessage, string, error) {
+	msgs, handle, err := c.bw.SubscribeH(p)
+	if err == nil && msgs == nil {
+		// nothing can be delivered, so don't leave the subscription open on the agent
+		if handle != "" {
+			c.bw.Unsubscribe(handle)
+		}
+		return nil, "", ErrNilChannel
+	}
+	return msgs, handle, err
+}
+
+// calls Query, turning a missing channel into ErrNilChannel
+func (c *Client) query(p *bw2.QueryParams) (chan *bw2.SimpleMessage, error) {
+	msgs, err := c.bw.Query(p)
+	if err == nil && msgs == nil {
+		return nil, ErrNilChannel
+	}
+	return msgs, err
+}
+
+// calls SubscribeH, giving up after timeout if it is positive. If the subscription is established after
+// we gave up, it is cancelled again
+func (c *Client) subscribeWithin(p *bw2.SubscribeParams, timeout time.Duration) (chan *bw2.SimpleMessage, string, error) {
+	if timeout <= 0 {
+		return c.subscribe(p)
+	}
+	type result struct {
+		msgs   chan *bw2.SimpleMessage
+		handle string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		msgs, handle, err := c.subscribe(p)
+		done <- result{msgs, handle, err}
+	}()
+	select {
+	case r := <-done:
+		return r.msgs, r.handle, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-done; r.err == nil {
+				if err := c.bw.Unsubscribe(r.handle); err != nil {
+					c.logf("Could not cancel late subscription on %s: %v", p.URI, err)
+				}
+			}
+		}()
+		return nil, "", ErrStartTimeout
+	}
+}
+
+// calls Query, giving up after timeout if it is positive. If the query is answered after we gave up,
+// the results are discarded
+func (c *Client) queryWithin(p *bw2.QueryParams, timeout time.Duration) (chan *bw2.SimpleMessage, error) {
+	if timeout <= 0 {
+		return c.query(p)
+	}
+	type result struct {
+		msgs chan *bw2.SimpleMessage
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		msgs, err := c.query(p)
+		done <- result{msgs, err}
+	}()
+	select {
+	case r := <-done:
+		return r.msgs, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-done; r.err == nil {
+				for range r.msgs {
+				}
+			}
+		}()
+		return nil, ErrStartTimeout
+	}
+}
+
+// re-establishes a dropped subscription, backing off exponentially between attempts, until it succeeds or
+// ctx is done. Failed attempts are passed to report
+func (c *Client) resubscribe(ctx context.Context, params *MultiSubscribeParams, p *bw2.SubscribeParams, dchain *objects.DChain, report func(error)) (chan *bw2.SimpleMessage, string, bool) {
+	backoff := params.ReconnectBackoff
+	if backoff <= 0 {
+		backoff = DefaultReconnectBackoff
+	}
+	maxBackoff := params.MaxReconnectBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxReconnectBackoff
+	}
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, "", false
+		}
+		msgs, handle, err := c.subscribeWithin(p, params.StartTimeout)
+		if err == nil {
+			c.logf("Resubscribed to %s", p.URI)
+			return msgs, handle, true
+		}
+		report(&ChainError{Chain: dchain, URI: p.URI, Op: "subscribe", Err: err})
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package bw2util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	bw2 "github.com/immesys/bw2bind"
+	"github.com/pkg/errors"
+)
+
+func TestNilChannels(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	w.bw.subscribeFn = func(p *bw2.SubscribeParams) (chan *bw2.SimpleMessage, string, error) {
+		return nil, "", nil
+	}
+	w.bw.queryFn = func(p *bw2.QueryParams) (chan *bw2.SimpleMessage, error) {
+		return nil, nil
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := w.c.MultiSubscribe("test.ns/a")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !failedWith(err, ErrNilChannel) {
+			t.Errorf("MultiSubscribe: got %v, want failures wrapping %v", err, ErrNilChannel)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MultiSubscribe hung on a nil channel")
+	}
+
+	go func() {
+		_, err := w.c.MultiQuery("test.ns/a")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !failedWith(err, ErrNilChannel) {
+			t.Errorf("MultiQuery: got %v, want failures wrapping %v", err, ErrNilChannel)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MultiQuery hung on a nil channel")
+	}
+}
+
+// whether err is a non-empty MultiError whose failures are all *ChainError wrapping want
+func failedWith(err error, want error) bool {
+	failures, ok := err.(MultiError)
+	if !ok || len(failures) == 0 {
+		return false
+	}
+	for _, failure := range failures {
+		if cerr, ok := failure.(*ChainError); !ok || cerr.Err != want {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStartTimeoutReported(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "a/*", "C")
+	w.bw.grant(w.ns, w.me, w.ns, "b/*", "C")
+	// the agent never answers the subscription on b/*
+	hang := make(chan struct{})
+	defer close(hang)
+	w.bw.subscribeFn = func(p *bw2.SubscribeParams) (chan *bw2.SimpleMessage, string, error) {
+		if p.URI == "test.ns/b/*" {
+			<-hang
+		}
+		return w.bw.liveSubscribe(p)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	params := &MultiSubscribeParams{URI: "test.ns/*", SkipQuery: true, StartTimeout: 20 * time.Millisecond}
+	msgs, errs, err := w.c.MultiSubscribeWithParamsErrors(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		cerr, ok := err.(*ChainError)
+		if !ok || cerr.URI != "test.ns/b/*" || errors.Cause(cerr.Err) != ErrStartTimeout {
+			t.Errorf("got %v, want a *ChainError on test.ns/b/* wrapping %v", err, ErrStartTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported for the chain that timed out")
+	}
+	cancel()
+	drain(t, msgs)
+}
+
+func TestQueryRetryFailureReported(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	queryErr := errors.New("query refused")
+	w.bw.queryFn = func(p *bw2.QueryParams) (chan *bw2.SimpleMessage, error) {
+		return nil, queryErr
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	params := &MultiSubscribeParams{URI: "test.ns/a", QueryRetry: RetryPolicy{Attempts: 3, Backoff: time.Millisecond}}
+	msgs, errs, err := w.c.MultiSubscribeWithParamsErrors(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		cerr, ok := err.(*ChainError)
+		if !ok || cerr.Op != "query" || cerr.Err != queryErr {
+			t.Errorf("got %v, want the last query error in a *ChainError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported for the failed query")
+	}
+	if len(w.bw.queries) != 3 {
+		t.Errorf("queried %d times, want 3", len(w.bw.queries))
+	}
+	cancel()
+	drain(t, msgs)
+}
@@ -0,0 +1,66 @@
+package bw2util
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	bw2 "github.com/immesys/bw2bind"
+)
+
+// A running MultiSubscribe whose chains can be stopped individually. Get one from MultiSubscribeHandle
+type Subscription struct {
+	// the demuxed messages, as returned by MultiSubscribeWithParams. Closed once every chain has stopped
+	C   chan *bw2.SimpleMessage
+	sub *activeSub
+}
+
+// Same as MultiSubscribeWithParams, but returns a Subscription, through which the subscriptions on
+// individual effective URIs can be stopped
+func (c *Client) MultiSubscribeHandle(ctx context.Context, params *MultiSubscribeParams) (*Subscription, error) {
+	sub, err := c.multiSubscribe(ctx, params, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Subscription{C: untag(sub.stop, sub.msgs), sub: sub}, nil
+}
+
+// Returns the effective URIs of the chains the subscription was started on that haven't been passed
+// to Unsubscribe, sorted. Chains that failed are included; their failures are reported as usual
+func (s *Subscription) URIs() []string {
+	s.sub.chainsLock.Lock()
+	defer s.sub.chainsLock.Unlock()
+	var uris []string
+	for uri := range s.sub.chains {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+// Returns a *ChainError wrapping ErrNoOverlap for each usable chain the subscription wasn't started on
+// because it doesn't overlap the URI at all. These are also reported like any other failure
+func (s *Subscription) Skipped() []*ChainError {
+	return s.sub.skipped
+}
+
+// Stops the subscription (and query) on every chain whose effective URI is effectiveURI, as listed by
+// URIs. The other chains keep delivering; C is closed once the last of them stops
+func (s *Subscription) Unsubscribe(effectiveURI string) error {
+	s.sub.chainsLock.Lock()
+	cancels, found := s.sub.chains[effectiveURI]
+	delete(s.sub.chains, effectiveURI)
+	s.sub.chainsLock.Unlock()
+	if !found {
+		return fmt.Errorf("Not subscribed to %s", effectiveURI)
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return nil
+}
+
+// Stops every chain of the subscription
+func (s *Subscription) Close() {
+	s.sub.cancel()
+}
@@ -0,0 +1,51 @@
+package bw2util
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/immesys/bw2/util"
+)
+
+// Checks that the URI is well-formed: it must have a non-empty namespace that isn't a wildcard, no leading
+// or trailing slashes, and no empty segments. '+' and '*' may only appear as whole segments, and '*' at most once
+func ValidateURI(uri string) error {
+	if len(uri) == 0 {
+		return fmt.Errorf("URI is empty")
+	}
+	if strings.HasPrefix(uri, "/") {
+		return fmt.Errorf("URI %s has a leading slash", uri)
+	}
+	if strings.HasSuffix(uri, "/") {
+		return fmt.Errorf("URI %s has a trailing slash", uri)
+	}
+	parts := strings.Split(uri, "/")
+	if strings.ContainsAny(parts[0], "+*") {
+		return fmt.Errorf("URI %s has a wildcard in its namespace %s", uri, parts[0])
+	}
+	stars := 0
+	for i, part := range parts {
+		if len(part) == 0 {
+			return fmt.Errorf("URI %s has an empty segment at position %d", uri, i)
+		}
+		if part == "*" {
+			stars++
+			continue
+		}
+		if part != "+" && strings.ContainsAny(part, "+*") {
+			return fmt.Errorf("URI %s has a wildcard inside segment %s; wildcards must be a whole segment", uri, part)
+		}
+	}
+	if stars > 1 {
+		return fmt.Errorf("URI %s has %d '*' wildcards; at most one is allowed", uri, stars)
+	}
+	return nil
+}
+
+// Returns the intersection of two URI patterns (with or without namespaces, as long as both are the same
+// form): the pattern matching exactly the resources that both pattern and by match. The boolean is false
+// if there are no such resources. For example, restricting a/*/c by a/b/+ gives a/b/c, while a/b and a/c
+// don't overlap. This is the restriction applied by each DOT in GetDChainURI
+func RestrictURI(pattern, by string) (string, bool) {
+	return util.RestrictBy(pattern, by)
+}
@@ -0,0 +1,28 @@
+package bw2util
+
+import "testing"
+
+func TestRestrictURI(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, by string
+		want        string
+		overlap     bool
+	}{
+		{"a/b", "a/b", "a/b", true},
+		{"a/b", "a/c", "", false},
+		{"a/*", "a/b/c", "a/b/c", true},
+		{"a/b/c", "a/*", "a/b/c", true},
+		{"a/*", "*", "a/*", true},
+		{"a/*/c", "a/b/+", "a/b/c", true},
+		{"a/+", "a/b/c", "", false},
+		{"a/+", "+/b", "a/b", true},
+		{"*", "a/*/!meta/giles", "a/*/!meta/giles", true},
+		{"a/*", "b/*", "", false},
+		{"a/*", "a", "a", true},
+	} {
+		got, overlap := RestrictURI(tc.pattern, tc.by)
+		if overlap != tc.overlap || (overlap && got != tc.want) {
+			t.Errorf("RestrictURI(%s, %s) = %q, %v, want %q, %v", tc.pattern, tc.by, got, overlap, tc.want, tc.overlap)
+		}
+	}
+}
@@ -3,15 +3,19 @@
 package bw2util
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"log"
-	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/immesys/bw2/objects"
-	"github.com/immesys/bw2/util"
 	bw2 "github.com/immesys/bw2bind"
 	"github.com/karlseguin/ccache"
 	"github.com/pkg/errors"
@@ -23,37 +27,517 @@ func fmtHash(hash []byte) string {
 	return base64.URLEncoding.EncodeToString(hash)
 }
 
+// returns true if s is already a base64 encoded VK (32 bytes) rather than an alias
+func isVK(s string) bool {
+	if len(s) != 44 {
+		return false
+	}
+	vk, err := base64.URLEncoding.DecodeString(s)
+	return err == nil && len(vk) == 32
+}
+
+// The subset of *bw2.BW2Client that this package uses, so tests can supply a fake agent
+type bwBackend interface {
+	ResolveRegistry(key string) (objects.RoutingObject, bw2.RegistryValidity, error)
+	FindDOTsFromVK(vk string) ([]objects.RoutingObject, []bw2.RegistryValidity, error)
+	SubscribeH(p *bw2.SubscribeParams) (chan *bw2.SimpleMessage, string, error)
+	Unsubscribe(handle string) error
+	Query(p *bw2.QueryParams) (chan *bw2.SimpleMessage, error)
+	Publish(p *bw2.PublishParams) error
+}
+
+// Receives the package's log output; *log.Logger satisfies this
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
 // Wrapper for bw2 client that provides additional functionality
 type Client struct {
 	*bw2.BW2Client
+	// all agent calls made by this package go through bw
+	bw       bwBackend
 	dupCache *ccache.Cache
 	vk       string
+
+	// DOTs that expire within this long from now are not used to build chains. This lets long-running
+	// subscribers avoid chains that are about to break. Expired DOTs are always skipped
+	ExpiryGrace time.Duration
+	// The longest DOT chain (in number of DOTs) the chain search will build. NewClient sets this
+	// to DefaultMaxChainLength; 0 means no limit
+	MaxChainLength int
+	// How many registry lookups a chain search may have in flight at once. NewClient sets this
+	// to DefaultMaxConcurrentLookups; values below 1 mean the search is serial
+	MaxConcurrentLookups int
+	// How the registry lookups made while searching for chains are retried. By default a failed lookup
+	// fails the whole search
+	LookupRetry RetryPolicy
+	// If non-nil, chain searches only use DOTs for which this returns true, e.g. to only trust DOTs given
+	// by certain VKs. It is applied on top of the built-in checks (validity, expiry, kind and permissions),
+	// not instead of them. Chains already cached are not affected; see InvalidateChainCache
+	DOTFilter func(*objects.DOT) bool
+	// If positive, at most this many per-chain subscriptions are open at once across all MultiSubscribes
+	// on the client. Chains beyond the limit are not subscribed to and are reported like any other
+	// failed chain, as a *ChainError wrapping ErrTooManySubscriptions; combine with a ChainSelector to
+	// choose which chains get used. By default there is no limit
+	MaxConcurrentSubscriptions int
+	subSlots                   int
+	subSlotsLock               sync.Mutex
+	// If non-zero, chains found for a namespace are reused for this long instead of searching
+	// again. Entries are dropped early when a DOT in one of the chains expires. See InvalidateChainCache
+	ChainCacheTTL time.Duration
+	chainCache    *ccache.LayeredCache
+	// running MultiSubscribes, so Close can stop them
+	subs     map[*activeSub]struct{}
+	subsLock sync.Mutex
+	closed   bool
+	// namespace alias -> NSVK; successful resolutions are kept until ClearNamespaceCache
+	nsCache map[string]string
+	nsLock  sync.Mutex
+	// Counters for chain discovery and subscription; allocated by NewClient
+	Metrics *Metrics
+	// Where diagnostics (e.g. per-chain errors nobody else is listening for) are logged.
+	// Nothing is logged if this is nil
+	Logger Logger
 }
 
+// takes one of the MaxConcurrentSubscriptions slots, returning false if there are none left
+func (c *Client) acquireSubscription() bool {
+	c.subSlotsLock.Lock()
+	defer c.subSlotsLock.Unlock()
+	if c.MaxConcurrentSubscriptions > 0 && c.subSlots >= c.MaxConcurrentSubscriptions {
+		return false
+	}
+	c.subSlots++
+	return true
+}
+
+func (c *Client) releaseSubscription() {
+	c.subSlotsLock.Lock()
+	c.subSlots--
+	c.subSlotsLock.Unlock()
+}
+
+func (c *Client) logf(format string, v ...interface{}) {
+	if c.Logger == nil {
+		return
+	}
+	c.Logger.Printf(format, v...)
+}
+
+const (
+	DefaultMaxChainLength       = 8
+	DefaultMaxConcurrentLookups = 4
+)
+
 func NewClient(client *bw2.BW2Client, vk string) (*Client, error) {
+	c, err := newClientFromBackend(client, vk)
+	if err != nil {
+		return nil, err
+	}
+	c.BW2Client = client
+	return c, nil
+}
+
+// Connects to the agent at agentAddr (the default agent if empty), sets the entity from entityFile and
+// returns a Client acting as that entity. Close disconnects from the agent
+func ConnectClient(agentAddr, entityFile string) (*Client, error) {
+	client, err := bw2.Connect(agentAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not connect to agent %s", agentAddr)
+	}
+	vk, err := client.SetEntityFile(entityFile)
+	if err != nil {
+		client.Close()
+		return nil, errors.Wrapf(err, "Could not set entity from %s", entityFile)
+	}
+	c, err := NewClient(client, vk)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// same as NewClient, but the embedded *bw2.BW2Client is left nil
+func newClientFromBackend(backend bwBackend, vk string) (*Client, error) {
 	if len(vk) == 0 {
 		return nil, fmt.Errorf("VK cannot be empty")
 	}
 	cache := ccache.New(ccache.Configure().MaxSize(10000))
-	return &Client{client, cache, vk}, nil
+	return &Client{
+		bw:                   backend,
+		dupCache:             cache,
+		vk:                   vk,
+		MaxChainLength:       DefaultMaxChainLength,
+		MaxConcurrentLookups: DefaultMaxConcurrentLookups,
+		chainCache:           ccache.Layered(ccache.Configure().MaxSize(1000)),
+		nsCache:              make(map[string]string),
+		subs:                 make(map[*activeSub]struct{}),
+		Metrics:              new(Metrics),
+	}, nil
 }
 
-// Given a URI, returns the base64 encoding of the namespace VK that is the base of the URI
+// Given a URI, returns the base64 encoding of the namespace VK that is the base of the URI. The URI may
+// be just the namespace, as in "scratch.ns"; "scratch.ns/" is rejected by ValidateURI. If the namespace
+// entity isn't valid in the registry, the NSVK is returned along with an ErrNamespaceUnverified
 func (c *Client) GetNamespaceVK(uri string) (string, error) {
-	parts := strings.Split(uri, "/")
-	if len(parts) == 0 {
-		return "", fmt.Errorf("Could not parse URI %s", uri)
+	return c.GetNamespaceVKContext(context.Background(), uri)
+}
+
+// Returned (wrapped, along with the NSVK) by GetNamespaceVK when the namespace resolved to an entity that
+// the registry doesn't consider valid, e.g. because it has expired or been revoked. Callers that want to
+// use the namespace anyway can check for it with errors.Cause
+var ErrNamespaceUnverified = errors.New("namespace entity is not valid in the registry")
+
+// Same as GetNamespaceVK, but gives up with ctx.Err() once the context is done. The registry lookup
+// itself can't be cancelled, so it finishes in the background
+func (c *Client) GetNamespaceVKContext(ctx context.Context, uri string) (string, error) {
+	if err := ValidateURI(uri); err != nil {
+		return "", err
 	}
-	head := parts[0]
-	ro, _, err := c.ResolveRegistry(head)
-	if err != nil {
+	// ValidateURI guarantees a non-empty namespace. A URI that is only a namespace is its own head
+	head := uriNamespace(uri)
+	// URIs can start with the namespace VK itself, which doesn't need resolving
+	if isVK(head) {
+		return head, nil
+	}
+	c.nsLock.Lock()
+	nsvk, found := c.nsCache[head]
+	c.nsLock.Unlock()
+	if found {
+		return nsvk, nil
+	}
+	entity, err := c.resolveNamespaceEntity(ctx, head)
+	if entity == nil {
 		return "", err
 	}
-	f := reflect.ValueOf(ro).MethodByName("GetVK")
-	nsvk := base64.URLEncoding.EncodeToString(f.Call([]reflect.Value{})[0].Bytes())
+	nsvk = fmtHash(entity.GetVK())
+	// an unverified namespace still has the right VK, but isn't usable, so don't cache it
+	if err != nil {
+		return nsvk, err
+	}
+	c.nsLock.Lock()
+	c.nsCache[head] = nsvk
+	c.nsLock.Unlock()
 	return nsvk, nil
 }
 
+// Resolves a namespace alias (or VK) to the entity in the registry, e.g. to read its contact and comment.
+// As for GetNamespaceVK, an entity the registry doesn't consider valid is returned along with an
+// ErrNamespaceUnverified. Results are not cached
+func (c *Client) ResolveNamespaceEntity(token string) (*objects.Entity, error) {
+	return c.resolveNamespaceEntity(context.Background(), token)
+}
+
+func (c *Client) resolveNamespaceEntity(ctx context.Context, token string) (*objects.Entity, error) {
+	ro, validity, err := c.resolveRegistry(ctx, token)
+	if err != nil && ro == nil {
+		return nil, err
+	}
+	// only entities have a VK that can be the base of a URI
+	entity, ok := ro.(*objects.Entity)
+	if !ok {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Namespace %s resolved to %T, not an entity", token, ro)
+	}
+	// the agent can hand back the entity along with an error or a bad validity
+	if err != nil {
+		return entity, errors.Wrapf(ErrNamespaceUnverified, "Namespace %s resolved with error %v", token, err)
+	}
+	if validity != bw2.StateValid {
+		return entity, errors.Wrapf(ErrNamespaceUnverified, "Namespace %s is %s", token, validityName(validity))
+	}
+	return entity, nil
+}
+
+// Same as GetNamespaceVK for each of the URIs, but each distinct namespace is only resolved once. The
+// map goes from each URI to its NSVK; URIs whose namespace couldn't be resolved are left out, and
+// their errors are returned together as a MultiError
+func (c *Client) GetNamespaceVKs(uris []string) (map[string]string, error) {
+	var (
+		nsvks    = make(map[string]string)
+		failures MultiError
+		// namespace -> NSVK, or "" if it failed
+		resolved = make(map[string]string)
+	)
+	for _, uri := range uris {
+		if err := ValidateURI(uri); err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		head := uriNamespace(uri)
+		nsvk, found := resolved[head]
+		if !found {
+			var err error
+			if nsvk, err = c.GetNamespaceVK(uri); err != nil {
+				failures = append(failures, errors.Wrapf(err, "Could not resolve namespace of %s", uri))
+				nsvk = ""
+			}
+			resolved[head] = nsvk
+		}
+		if nsvk != "" {
+			nsvks[uri] = nsvk
+		}
+	}
+	if len(failures) > 0 {
+		return nsvks, failures
+	}
+	return nsvks, nil
+}
+
+// describes a registry validity for error messages
+func validityName(validity bw2.RegistryValidity) string {
+	switch validity {
+	case bw2.StateValid:
+		return "valid"
+	case bw2.StateExpired:
+		return "expired"
+	case bw2.StateRevoked:
+		return "revoked"
+	case bw2.StateError:
+		return "in an error state"
+	default:
+		return "of unknown validity"
+	}
+}
+
+// calls ResolveRegistry, returning ctx.Err() if the context is done first
+func (c *Client) resolveRegistry(ctx context.Context, key string) (objects.RoutingObject, bw2.RegistryValidity, error) {
+	type result struct {
+		ro       objects.RoutingObject
+		validity bw2.RegistryValidity
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ro, validity, err := c.bw.ResolveRegistry(key)
+		done <- result{ro, validity, err}
+	}()
+	select {
+	case r := <-done:
+		return r.ro, r.validity, r.err
+	case <-ctx.Done():
+		var validity bw2.RegistryValidity
+		return nil, validity, ctx.Err()
+	}
+}
+
+// Forgets every namespace resolved by GetNamespaceVK, so they are looked up in the registry again
+func (c *Client) ClearNamespaceCache() {
+	c.nsLock.Lock()
+	c.nsCache = make(map[string]string)
+	c.nsLock.Unlock()
+}
+
+// An error from the subscription or query on one of the chains used by MultiSubscribe
+type ChainError struct {
+	// the chain that failed; nil for a namespace we own, which needs no chain
+	Chain *objects.DChain
+	// the effective URI we were using on the chain
+	URI string
+	// which operation failed: "subscribe", "query", "unsubscribe" or "publish"
+	Op  string
+	Err error
+}
+
+func (e *ChainError) Error() string {
+	if e.Chain == nil {
+		return fmt.Sprintf("%s on %s (no chain) failed: %v", e.Op, e.URI, e.Err)
+	}
+	return fmt.Sprintf("%s on %s (chain %s) failed: %v", e.Op, e.URI, fmtHash(e.Chain.GetChainHash()), e.Err)
+}
+
+// A collection of errors from operations that were attempted independently (e.g. one per chain)
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Extra options for MultiSubscribeWithParams. The zero value (apart from URI) behaves like MultiSubscribe
+type MultiSubscribeParams struct {
+	// the URI to subscribe to
+	URI string
+	// if true, a message is only delivered once per DedupWindow even if it
+	// arrives through several chains. Messages are identical if they have
+	// the same URI and the same payload objects
+	Dedup bool
+	// how long a message is remembered for Dedup; DefaultDedupWindow if 0
+	DedupWindow time.Duration
+	// picks which of the usable chains to subscribe on; AllChains if nil
+	Selector ChainSelector
+	// if non-nil, only chains that pass (or avoid) its VK are considered
+	VKFilter *VKFilter
+	// which permission the chains must grant; ModeConsume by default
+	Mode PermissionMode
+	// if true, only live subscriptions are opened; by default each chain is also queried
+	// for persisted messages
+	SkipQuery bool
+	// if non-nil, every per-chain subscription (and query) is made with a copy of this, e.g. to set
+	// Expiry or LeavePacked. URI, MVK, URISuffix, PrimaryAccessChain, RoutingObjects and AutoChain
+	// are always filled in per chain. ElaboratePAC (e.g. bw2.ElaborateFull or bw2.ElaborateNone) is
+	// used for both the subscriptions and the queries; if it is empty, bw2.ElaboratePartial is used.
+	// Setting DoNotVerify skips the agent's verification of each delivered message, which saves work
+	// on busy subscriptions but means forged or unauthorized messages are delivered too; only use it
+	// when every publisher on the URI is trusted. Messages are verified by default
+	Template *bw2.SubscribeParams
+	// if positive, a per-chain subscription or query the agent hasn't established within this long is
+	// abandoned and reported as a *ChainError wrapping ErrStartTimeout (see MultiSubscribeWithParamsErrors).
+	// By default we wait forever
+	StartTimeout time.Duration
+	// if true, a per-chain subscription that the agent closes while the context is still live (e.g. because
+	// the agent restarted) is re-established, waiting ReconnectBackoff before the first attempt and doubling
+	// the wait after each failure up to MaxReconnectBackoff. Each drop and failed attempt is reported as a
+	// *ChainError. By default a dropped chain simply stops delivering
+	Reconnect bool
+	// DefaultReconnectBackoff if 0
+	ReconnectBackoff time.Duration
+	// DefaultMaxReconnectBackoff if 0
+	MaxReconnectBackoff time.Duration
+	// if positive, messages keep being delivered for this long after the context is cancelled (or the
+	// client closed), so those already on their way aren't lost. Teardown, including Close, takes that
+	// much longer, and live messages arriving in the meantime are delivered too. By default delivery
+	// stops immediately
+	DrainTimeout time.Duration
+	// if non-empty, only messages with at least one payload object of one of these PO numbers are
+	// delivered. This is applied to the messages as they arrive, on top of any filtering by the agent
+	POFilter []int
+	// how the query on each chain is retried if it fails to start. Only the last error is reported, on the
+	// error channel of MultiSubscribeWithParamsErrors if there is one. By default each query is tried once
+	QueryRetry RetryPolicy
+}
+
+// returns the parameters for subscribing on one chain
+func (params *MultiSubscribeParams) subscribeParams(uri string, dchain *objects.DChain) *bw2.SubscribeParams {
+	var p bw2.SubscribeParams
+	if params.Template != nil {
+		p = *params.Template
+	}
+	p.MVK = nil
+	p.URISuffix = ""
+	p.PrimaryAccessChain = ""
+	p.URI = uri
+	p.AutoChain = false
+	p.RoutingObjects = routingObjects(dchain)
+	if p.ElaboratePAC == bw2.ElaborateDefault {
+		p.ElaboratePAC = bw2.ElaboratePartial
+	}
+	return &p
+}
+
+// returns the routing objects for a request on the chain. The nil chain of a namespace we own needs
+// none, because the namespace owner has access to everything
+func routingObjects(dchain *objects.DChain) []objects.RoutingObject {
+	if dchain == nil {
+		return nil
+	}
+	return []objects.RoutingObject{dchain}
+}
+
+// returns the parameters for querying on one chain, taken from the same template as subscribeParams
+func (params *MultiSubscribeParams) queryParams(uri string, dchain *objects.DChain) *bw2.QueryParams {
+	sp := params.subscribeParams(uri, dchain)
+	return &bw2.QueryParams{
+		URI:            sp.URI,
+		AutoChain:      sp.AutoChain,
+		RoutingObjects: sp.RoutingObjects,
+		ElaboratePAC:   sp.ElaboratePAC,
+		Expiry:         sp.Expiry,
+		ExpiryDelta:    sp.ExpiryDelta,
+		DoNotVerify:    sp.DoNotVerify,
+		LeavePacked:    sp.LeavePacked,
+	}
+}
+
+// Which permission the chains used by MultiSubscribe must grant
+type PermissionMode int
+
+const (
+	// only chains granting consume
+	ModeConsume PermissionMode = iota
+	// only chains granting tap, for observing without consuming
+	ModeTap
+	// chains granting either
+	ModeConsumeOrTap
+)
+
+func (mode PermissionMode) filter() permFilter {
+	switch mode {
+	case ModeTap:
+		return canTap
+	case ModeConsumeOrTap:
+		return canConsumeOrTap
+	default:
+		return canConsume
+	}
+}
+
+const DefaultDedupWindow = 30 * time.Second
+
+// wraps isNew so that messages without a payload object of one of the ponums are rejected before
+// they are considered for deduplication
+func poFilter(ponums []int, isNew func(*bw2.SimpleMessage) bool) func(*bw2.SimpleMessage) bool {
+	wanted := make(map[int]struct{}, len(ponums))
+	for _, ponum := range ponums {
+		wanted[ponum] = struct{}{}
+	}
+	return func(msg *bw2.SimpleMessage) bool {
+		for _, po := range msg.POs {
+			if _, found := wanted[po.GetPONum()]; found {
+				return isNew(msg)
+			}
+		}
+		return false
+	}
+}
+
+// remembers hashes of (URI, payload objects) for a sliding window
+type contentDeduper struct {
+	sync.Mutex
+	seen   *ccache.Cache
+	window time.Duration
+}
+
+func newContentDeduper(window time.Duration) *contentDeduper {
+	return &contentDeduper{
+		seen:   ccache.New(ccache.Configure().MaxSize(1000)),
+		window: window,
+	}
+}
+
+// returns true if no message with the same URI and payload objects was seen in the window
+func (d *contentDeduper) isNew(msg *bw2.SimpleMessage) bool {
+	h := sha256.New()
+	// each field is length-prefixed, so that e.g. URI ns/a1 with PO 2.0.0.0 doesn't hash the same as
+	// URI ns/a with PO 12.0.0.0
+	field := func(b []byte) {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	field([]byte(msg.URI))
+	for _, po := range msg.POs {
+		field([]byte(po.GetPODotNum()))
+		field(po.GetContents())
+	}
+	key := string(h.Sum(nil))
+
+	d.Lock()
+	defer d.Unlock()
+	if item := d.seen.Get(key); item != nil && !item.Expired() {
+		return false
+	}
+	d.seen.Set(key, struct{}{}, d.window)
+	return true
+}
+
 // returns true if we haven't seen this message before; this will double check
 // the message cache
 func (c *Client) messageIsNew(msg *bw2.SimpleMessage) bool {
@@ -68,96 +552,607 @@ func (c *Client) messageIsNew(msg *bw2.SimpleMessage) bool {
 	return false
 }
 
-//TODO: get the overlap of all found dchains
-
 // I want to subscribe to some broad pattern (e.g. scatch.ns/*/!meta/giles), but my access is distributed over
 // several different different DOT chains. In order to do this, we first find *all* chains from the Namespace VK
-// of the subscription URI to our own VK. For each of these chains (modulo any overlaps), we create a subscription
-// manually specifying the primary access chain, then demux these subscriptions into a single channel which is returned
+// of the subscription URI to our own VK. For each of these chains (modulo any overlaps, see PruneRedundantChains), we create a subscription
+// manually specifying the primary access chain, then demux these subscriptions into a single channel which is returned.
+// The returned channel is closed once every per-chain subscription and query has finished. If no chain
+// could be subscribed on at all, an error is returned instead. If the namespace is our own VK there are no
+// chains to find, so the URI is subscribed to directly
 func (c *Client) MultiSubscribe(uri string) (chan *bw2.SimpleMessage, error) {
-	// get NSVK for URI
-	nsvk, err := c.GetNamespaceVK(uri)
+	return c.MultiSubscribeContext(context.Background(), uri)
+}
+
+// Same as MultiSubscribe, but all subscriptions are torn down when the context is cancelled. Cancelling
+// the context also closes the returned channel
+func (c *Client) MultiSubscribeContext(ctx context.Context, uri string) (chan *bw2.SimpleMessage, error) {
+	return c.MultiSubscribeWithParams(ctx, &MultiSubscribeParams{URI: uri})
+}
+
+// Same as MultiSubscribe, but failures of the per-chain subscriptions and queries are delivered as
+// *ChainError on the returned error channel instead of being logged. The error channel is closed
+// together with the message channel; it must be drained or the failing goroutines will block
+func (c *Client) MultiSubscribeWithErrors(uri string) (chan *bw2.SimpleMessage, <-chan error, error) {
+	return c.MultiSubscribeWithParamsErrors(context.Background(), &MultiSubscribeParams{URI: uri})
+}
+
+// Same as MultiSubscribeWithParams, but per-chain failures are delivered on the returned error channel as
+// in MultiSubscribeWithErrors, e.g. to see which chains hit StartTimeout or which queries QueryRetry gave
+// up on
+func (c *Client) MultiSubscribeWithParamsErrors(ctx context.Context, params *MultiSubscribeParams) (chan *bw2.SimpleMessage, <-chan error, error) {
+	errs := make(chan error, 10)
+	sub, err := c.multiSubscribe(ctx, params, nil, errs)
 	if err != nil {
-		return nil, errors.Wrap(err, "Could not resolve namespace")
+		return nil, nil, err
 	}
+	return untag(sub.stop, sub.msgs), errs, nil
+}
 
-	// build all of the chains we can use to subscribe
-	_dchains, err := c.FindDOTChains(nsvk)
+// Same as MultiSubscribeContext, but with the extra options in MultiSubscribeParams
+func (c *Client) MultiSubscribeWithParams(ctx context.Context, params *MultiSubscribeParams) (chan *bw2.SimpleMessage, error) {
+	sub, err := c.multiSubscribe(ctx, params, nil, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "Could not find DOT chains")
-	}
-
-	demuxed := make(chan *bw2.SimpleMessage, 10)
-
-	// get the set of unique URIs for dchains so we can see if they overlap
-	var uris []string
-	var dchains []*objects.DChain
-	for _, dchain := range _dchains {
-		// check that the dchain has a valid URI and that its TTL isn't expired
-		if suburi := GetDChainURI(dchain, uri); len(suburi) > 0 && dchain.GetTTL() >= 0 {
-			var found = false
-			for _, u := range uris {
-				if u == suburi {
-					found = true
-					break
-				}
+		return nil, err
+	}
+	return untag(sub.stop, sub.msgs), nil
+}
+
+// Same as MultiSubscribe, but also returns the effective URIs that were subscribed to after the chains
+// restricted the requested URI (see GetDChainURI). The usable chains left out because they don't overlap
+// the URI at all are listed by Subscription.Skipped
+func (c *Client) MultiSubscribeVerbose(uri string) (chan *bw2.SimpleMessage, []string, error) {
+	sub, err := c.multiSubscribe(context.Background(), &MultiSubscribeParams{URI: uri}, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return untag(sub.stop, sub.msgs), sub.uris, nil
+}
+
+// Same as MultiSubscribeWithParams, but each message is tagged with the chain and effective URI it
+// was received through
+func (c *Client) MultiSubscribeTagged(ctx context.Context, params *MultiSubscribeParams) (chan *TaggedMessage, error) {
+	sub, err := c.multiSubscribe(ctx, params, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sub.msgs, nil
+}
+
+// Same as MultiSubscribe, but handler is called with each message instead of sending it on a channel.
+// Calls are made one at a time from a goroutine of our own, so a slow handler holds up delivery.
+// The returned cancel function tears down all of the subscriptions; it can be called more than once,
+// including from inside handler
+func (c *Client) MultiSubscribeHandler(uri string, handler func(*bw2.SimpleMessage)) (cancel func(), err error) {
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	sub, err := c.multiSubscribe(ctx, &MultiSubscribeParams{URI: uri}, nil, nil)
+	if err != nil {
+		cancelCtx()
+		return nil, err
+	}
+	go func() {
+		for msg := range sub.msgs {
+			// messages already in flight when we are cancelled are dropped
+			if sub.ctx.Err() == nil {
+				handler(msg.Msg)
 			}
-			if !found {
-				uris = append(uris, suburi)
-				dchains = append(dchains, dchain)
+		}
+	}()
+	return cancelCtx, nil
+}
+
+// Subscribes to the URI as MultiSubscribeContext does, waits for the first message and returns it. Every
+// subscription is torn down before returning, including when the context is done first, in which case
+// ctx.Err() is returned
+func (c *Client) SubscribeOnce(ctx context.Context, uri string) (*bw2.SimpleMessage, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	msgs, err := c.MultiSubscribeContext(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case msg, ok := <-msgs:
+		if !ok {
+			// the subscriptions ended on their own, or the context was cancelled as we got here
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
 			}
+			return nil, fmt.Errorf("Subscriptions on %s ended without a message", uri)
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Same as MultiSubscribe, but subscribes to suffix (which may be empty) in each of the namespaces and
+// merges the messages into one channel, as MultiSubscribeAll does for the URIs made by joining each
+// namespace with the suffix
+func (c *Client) MultiSubscribeNamespaces(namespaces []string, suffix string) (chan *bw2.SimpleMessage, error) {
+	if len(namespaces) == 0 {
+		return nil, fmt.Errorf("No namespaces to subscribe in")
+	}
+	uris := make([]string, len(namespaces))
+	for i, ns := range namespaces {
+		uris[i] = joinURI(ns, suffix)
+	}
+	return c.MultiSubscribeAll(uris)
+}
+
+// Same as MultiSubscribe, but subscribes to each of the URIs and merges the messages into one channel.
+// The chains on each namespace are only looked for once, however many of the URIs are in it. A URI that
+// can't be subscribed to is logged and skipped; an error is only returned if none of them can be
+func (c *Client) MultiSubscribeAll(uris []string) (chan *bw2.SimpleMessage, error) {
+	var (
+		subs     []*activeSub
+		failures MultiError
+		source   = c.sharedChains()
+	)
+	for _, uri := range uris {
+		sub, err := c.multiSubscribe(context.Background(), &MultiSubscribeParams{URI: uri}, source, nil)
+		if err != nil {
+			failures = append(failures, errors.Wrapf(err, "Could not subscribe to %s", uri))
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	if len(subs) == 0 {
+		if len(failures) == 0 {
+			return nil, fmt.Errorf("No URIs to subscribe to")
 		}
+		return nil, failures
+	}
+	for _, err := range failures {
+		c.logf("%v", err)
 	}
+	merged, ctx := mergeSubs(subs)
+	return untag(ctx.Done(), merged), nil
+}
+
+// returns a chainSource that only searches each namespace once per filter, and hands out the same
+// chains every time after that. It is not safe for concurrent use
+func (c *Client) sharedChains() chainSource {
+	found := make(map[string][]*objects.DChain)
+	return func(ctx context.Context, nsvk string, filter permFilter) ([]*objects.DChain, error) {
+		key := filter.name + "/" + canonicalVK(nsvk)
+		if dchains, searched := found[key]; searched {
+			return dchains, nil
+		}
+		dchains, err := c.findChains(ctx, nsvk, filter)
+		if err != nil {
+			return nil, err
+		}
+		found[key] = dchains
+		return dchains, nil
+	}
+}
+
+// merges the messages of several subscriptions into one channel, which is closed once all of theirs are.
+// The returned context is done at the same time
+func mergeSubs(subs []*activeSub) (chan *TaggedMessage, context.Context) {
+	out := make(chan *TaggedMessage, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(len(subs))
+	for _, sub := range subs {
+		go func(sub *activeSub) {
+			defer wg.Done()
+			for msg := range sub.msgs {
+				select {
+				case out <- msg:
+				case <-sub.stop:
+					// keep draining until sub.msgs is closed
+				}
+			}
+		}(sub)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+		cancel()
+	}()
+	return out, ctx
+}
+
+// does the work for all of the MultiSubscribe variants. If errs is non-nil, per-chain errors are sent on it
+// and it is closed along with the demuxed channel; otherwise the errors are logged. If there are no chains,
+// or none of the subscriptions and queries could be started, a MultiError of the failures is returned instead.
+// The chains are taken from source, or searched for with findChains if it is nil
+func (c *Client) multiSubscribe(ctx context.Context, params *MultiSubscribeParams, source chainSource, errs chan error) (*activeSub, error) {
+	uri := params.URI
+	if err := ValidateURI(uri); err != nil {
+		return nil, err
+	}
+
+	// build all of the chains we can use to subscribe. The chains that don't overlap the URI go along
+	// without an effective URI, so subscribeChains reports them
+	dchains, uris, skipped, err := c.usableChainsFrom(ctx, source, uri, params.Mode.filter(), params.VKFilter, params.Selector)
+	if err != nil {
+		return nil, err
+	}
+	dchains = append(dchains, skipped...)
+	uris = append(uris, make([]string, len(skipped))...)
+	return c.subscribeChains(ctx, params, dchains, uris, errs)
+}
+
+// returns true if the namespace VK is our own VK, in which case we have full access to it without any DOTs
+func (c *Client) ownsNamespace(nsvk string) bool {
+	return canonicalVK(nsvk) == canonicalVK(c.vk)
+}
+
+// subscribes (and queries) on each of the chains at the matching effective URI, as multiSubscribe.
+// A nil chain subscribes to its URI without a routing object, which only works in our own namespace
+func (c *Client) subscribeChains(ctx context.Context, params *MultiSubscribeParams, dchains []*objects.DChain, uris []string, errs chan error) (*activeSub, error) {
+	// messages are always deduplicated by signature; optionally also by content
+	isNew := c.messageIsNew
+	if params.Dedup {
+		window := params.DedupWindow
+		if window <= 0 {
+			window = DefaultDedupWindow
+		}
+		byContent := newContentDeduper(window).isNew
+		isNew = func(msg *bw2.SimpleMessage) bool {
+			return c.messageIsNew(msg) && byContent(msg)
+		}
+	}
+	if len(params.POFilter) > 0 {
+		isNew = poFilter(params.POFilter, isNew)
+	}
+
+	// a chain without an effective URI would subscribe to the wrong thing, so it is reported along with
+	// any other failures instead
+	dchains, uris, skipped := overlappingChains(dchains, uris, params.URI)
+	var failures MultiError
+	for _, err := range skipped {
+		failures = append(failures, err)
+	}
+
+	demuxed := make(chan *TaggedMessage, 10)
+
+	// register with the client so Close can tear us down
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &activeSub{
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		stop:    drainDeadline(ctx, params.DrainTimeout),
+		msgs:    demuxed,
+		uris:    uris,
+		skipped: skipped,
+		chains:  make(map[string][]context.CancelFunc),
+	}
+	if err := c.track(sub); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// track every subscribe/query goroutine so we know when to close demuxed
+	var wg sync.WaitGroup
+	legs := 2 * len(dchains)
+	if params.SkipQuery {
+		legs = len(dchains)
+	}
+	wg.Add(legs)
+
+	report := func(err error) {
+		if errs == nil {
+			c.logf("%v", err)
+			return
+		}
+		select {
+		case errs <- err:
+		case <-ctx.Done():
+		}
+	}
+
+	// every subscribe/query sends exactly one value here once the agent has answered: nil if it
+	// started, otherwise a *ChainError
+	started := make(chan error, legs)
 
 	for i, dchain := range dchains {
 		// first form the actual subscription URI
 		subURI := uris[i]
-		fmt.Println("Subscribe to", subURI)
-		go func(uri string, dchain *objects.DChain) {
-			cc, err := c.Subscribe(&bw2.SubscribeParams{
-				URI:            subURI,
-				AutoChain:      false,
-				RoutingObjects: []objects.RoutingObject{dchain},
-				ElaboratePAC:   bw2.ElaboratePartial,
-			})
+		c.logf("Subscribe to %s", subURI)
+		// each chain can be stopped on its own, see Subscription.Unsubscribe
+		chainCtx, chainCancel := context.WithCancel(ctx)
+		chainStop := drainDeadline(chainCtx, params.DrainTimeout)
+		sub.chains[subURI] = append(sub.chains[subURI], chainCancel)
+		// slots are taken in order, so with MaxConcurrentSubscriptions the earlier chains win
+		slot := c.acquireSubscription()
+		go func(uri string, dchain *objects.DChain, slot bool) {
+			defer wg.Done()
+			if !slot {
+				started <- &ChainError{Chain: dchain, URI: uri, Op: "subscribe", Err: ErrTooManySubscriptions}
+				return
+			}
+			defer c.releaseSubscription()
+			p := params.subscribeParams(uri, dchain)
+			msgs, handle, err := c.subscribeWithin(p, params.StartTimeout)
 			if err != nil {
-				fmt.Println(err)
+				started <- &ChainError{Chain: dchain, URI: uri, Op: "subscribe", Err: err}
 				return
 			}
-			for msg := range cc {
-				if c.messageIsNew(msg) {
-					demuxed <- msg
+			started <- nil
+			atomic.AddInt64(&c.Metrics.ActiveSubscriptions, 1)
+			defer atomic.AddInt64(&c.Metrics.ActiveSubscriptions, -1)
+			for {
+				c.forward(chainStop, msgs, demuxed, isNew, dchain, uri)
+				// if we stopped because of the context, the subscription is still live on the agent
+				if chainCtx.Err() != nil {
+					if err := c.bw.Unsubscribe(handle); err != nil {
+						report(&ChainError{Chain: dchain, URI: uri, Op: "unsubscribe", Err: err})
+					}
+					return
+				}
+				// otherwise the agent closed the subscription on us
+				if !params.Reconnect {
+					return
+				}
+				report(&ChainError{Chain: dchain, URI: uri, Op: "subscribe", Err: ErrSubscriptionDropped})
+				var ok bool
+				if msgs, handle, ok = c.resubscribe(chainCtx, params, p, dchain, report); !ok {
+					return
 				}
 			}
-		}(subURI, dchain)
+		}(subURI, dchain, slot)
+		if params.SkipQuery {
+			continue
+		}
 		go func(uri string, dchain *objects.DChain) {
-			cc, err := c.Query(&bw2.QueryParams{
-				URI:            subURI,
-				AutoChain:      false,
-				RoutingObjects: []objects.RoutingObject{dchain},
-				ElaboratePAC:   bw2.ElaboratePartial,
+			defer wg.Done()
+			var msgs chan *bw2.SimpleMessage
+			err := params.QueryRetry.do(chainCtx, func() (err error) {
+				msgs, err = c.queryWithin(params.queryParams(uri, dchain), params.StartTimeout)
+				return err
 			})
 			if err != nil {
-				fmt.Println(err)
+				started <- &ChainError{Chain: dchain, URI: uri, Op: "query", Err: err}
 				return
 			}
-			for msg := range cc {
-				if c.messageIsNew(msg) {
-					demuxed <- msg
+			started <- nil
+			c.forward(chainStop, msgs, demuxed, isNew, dchain, uri)
+		}(subURI, dchain)
+	}
+
+	// wait for every subscribe/query to start so that total failure doesn't look like success
+	failed := 0
+	for i := 0; i < legs; i++ {
+		if err := <-started; err != nil {
+			failures = append(failures, err)
+			failed++
+		}
+	}
+	if failed == legs {
+		cancel()
+		wg.Wait()
+		c.untrack(sub)
+		close(sub.done)
+		if len(failures) == 0 {
+			return nil, fmt.Errorf("No chains grant %s on %s", params.Mode.filter().name, params.URI)
+		}
+		return nil, failures
+	}
+	// the rest are still running, so hand the partial failures over the usual way
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, err := range failures {
+			report(err)
+		}
+	}()
+
+	// this is the only place demuxed is closed, so it happens exactly once
+	go func() {
+		wg.Wait()
+		close(demuxed)
+		if errs != nil {
+			close(errs)
+		}
+		cancel()
+		c.untrack(sub)
+		close(sub.done)
+	}()
+
+	return sub, nil
+}
+
+// drops the chains whose effective URI is empty because they don't overlap uri, returning a *ChainError
+// wrapping ErrNoOverlap (with the DOT that doesn't overlap, where GetDChainURIErr can tell) for each of them
+func overlappingChains(dchains []*objects.DChain, uris []string, uri string) ([]*objects.DChain, []string, []*ChainError) {
+	var (
+		keptChains []*objects.DChain
+		keptURIs   []string
+		skipped    []*ChainError
+	)
+	for i, dchain := range dchains {
+		if uris[i] == "" {
+			err := error(ErrNoOverlap)
+			if dchain != nil {
+				if _, why := GetDChainURIErr(dchain, uri); why != nil {
+					err = why
 				}
 			}
-		}(subURI, dchain)
+			skipped = append(skipped, &ChainError{Chain: dchain, URI: uri, Op: "subscribe", Err: err})
+			continue
+		}
+		keptChains = append(keptChains, dchain)
+		keptURIs = append(keptURIs, uris[i])
 	}
+	return keptChains, keptURIs, skipped
+}
 
-	return demuxed, nil
+// strips the tags from the messages of a tagged channel. The returned channel is closed once tagged is;
+// once stop is closed, messages nobody is waiting for are dropped
+func untag(stop <-chan struct{}, tagged chan *TaggedMessage) chan *bw2.SimpleMessage {
+	out := make(chan *bw2.SimpleMessage, 10)
+	go func() {
+		defer close(out)
+		for msg := range tagged {
+			select {
+			case out <- msg.Msg:
+			case <-stop:
+				// keep draining until tagged is closed
+			}
+		}
+	}()
+	return out
+}
+
+// returns a channel that is closed drain after ctx is done, which is when a shutting down subscription
+// stops delivering messages. Without a drain this is just ctx.Done()
+func drainDeadline(ctx context.Context, drain time.Duration) <-chan struct{} {
+	if drain <= 0 {
+		return ctx.Done()
+	}
+	stop := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		time.Sleep(drain)
+		close(stop)
+	}()
+	return stop
+}
+
+// a running MultiSubscribe; done is closed once all of its goroutines have exited
+type activeSub struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	// closed once ctx is done and the drain timeout has passed
+	stop <-chan struct{}
+	// the demuxed messages
+	msgs chan *TaggedMessage
+	// the effective URIs subscribed to
+	uris []string
+	// the chains not subscribed to because they don't overlap the URI
+	skipped []*ChainError
+	// effective URI -> cancels the subscriptions and queries on the chains with that URI
+	chains     map[string][]context.CancelFunc
+	chainsLock sync.Mutex
+}
+
+func (c *Client) track(sub *activeSub) error {
+	c.subsLock.Lock()
+	defer c.subsLock.Unlock()
+	if c.closed {
+		return fmt.Errorf("Client is closed")
+	}
+	c.subs[sub] = struct{}{}
+	return nil
+}
+
+func (c *Client) untrack(sub *activeSub) {
+	c.subsLock.Lock()
+	delete(c.subs, sub)
+	c.subsLock.Unlock()
+}
+
+// Cancels every running MultiSubscribe on this client and waits for their goroutines to exit, then
+// closes the embedded BW2Client if there is one. Subscribing after Close returns an error
+func (c *Client) Close() error {
+	c.subsLock.Lock()
+	c.closed = true
+	var subs []*activeSub
+	for sub := range c.subs {
+		subs = append(subs, sub)
+	}
+	c.subsLock.Unlock()
+
+	for _, sub := range subs {
+		sub.cancel()
+	}
+	for _, sub := range subs {
+		<-sub.done
+	}
+	if c.BW2Client != nil {
+		return c.BW2Client.Close()
+	}
+	return nil
 }
 
-// finds valid access DOTs granted from the given VK
-func (c *Client) findDOTsFromVK(fromvk string) ([]*objects.DOT, error) {
+// copies messages for which isNew returns true from msgs to out, tagged with the chain and URI they
+// came from, until msgs or stop is closed
+func (c *Client) forward(stop <-chan struct{}, msgs chan *bw2.SimpleMessage, out chan *TaggedMessage, isNew func(*bw2.SimpleMessage) bool, dchain *objects.DChain, uri string) {
+	for {
+		select {
+		case <-stop:
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			if !isNew(msg) {
+				continue
+			}
+			select {
+			case out <- &TaggedMessage{Msg: msg, Chain: dchain, URI: uri}:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// decides whether a DOT is one we are building a chain for. Access filters only see access DOTs on the
+// namespace being searched; the others only see permission DOTs, which aren't tied to a namespace.
+// The name identifies the filter in the chain cache
+type permFilter struct {
+	name   string
+	access bool
+	accept func(*objects.DOT) bool
+	// for access filters, whether a permission set (of a DOT or of a whole chain) is acceptable
+	grants func(*objects.AccessDOTPermissionSet) bool
+}
+
+// a filter for access DOTs whose permission sets pass grants
+func accessFilter(name string, grants func(*objects.AccessDOTPermissionSet) bool) permFilter {
+	return permFilter{
+		name:   name,
+		access: true,
+		accept: func(dot *objects.DOT) bool {
+			return grants(dot.GetPermissionSet())
+		},
+		grants: grants,
+	}
+}
+
+var (
+	canConsume = accessFilter("consume", func(permset *objects.AccessDOTPermissionSet) bool {
+		return permset.CanConsume
+	})
+	canPublish = accessFilter("publish", func(permset *objects.AccessDOTPermissionSet) bool {
+		return permset.CanPublish
+	})
+	canTap = accessFilter("tap", func(permset *objects.AccessDOTPermissionSet) bool {
+		return permset.CanTap
+	})
+	canConsumeOrTap = accessFilter("consume or tap", func(permset *objects.AccessDOTPermissionSet) bool {
+		return permset.CanConsume || permset.CanTap
+	})
+	canDelegate = permFilter{
+		name: "permission",
+		accept: func(dot *objects.DOT) bool {
+			return len(dot.GetPermissions()) > 0
+		},
+	}
+)
+
+// finds valid DOTs granted from the given VK that pass the filter. If trace is non-nil, it records why
+// the other DOTs were left out
+func (c *Client) findDOTsFromVK(ctx context.Context, fromvk string, filter permFilter, trace *searchTrace) ([]*objects.DOT, error) {
 	var (
 		retDOTs []*objects.DOT
+		// the agent may still report DOTs as valid after they expire
+		cutoff = time.Now().Add(c.ExpiryGrace)
 	)
-	dots, valids, err := c.FindDOTsFromVK(fromvk)
+	var (
+		dots   []objects.RoutingObject
+		valids []bw2.RegistryValidity
+	)
+	err := c.LookupRetry.do(ctx, func() (err error) {
+		dots, valids, err = c.bw.FindDOTsFromVK(fromvk)
+		return err
+	})
 	if err != nil {
 		return retDOTs, err
 	}
@@ -165,16 +1160,25 @@ func (c *Client) findDOTsFromVK(fromvk string) ([]*objects.DOT, error) {
 		_dot, err := objects.NewDOT(ro.GetRONum(), ro.GetContent())
 		// skip invalid DOTs
 		if valids[i] != bw2.StateValid {
+			trace.skip("not valid in the registry")
 			continue
 		}
 		if err != nil {
-			return retDOTs, err
+			// we can't get at the DOT hash, so identify the DOT by where it came from and its content
+			sum := sha256.Sum256(ro.GetContent())
+			return retDOTs, errors.Wrapf(err, "Could not parse DOT %d of %d granted from %s (content hash %s)", i+1, len(dots), fromvk, fmtHash(sum[:]))
 		}
 		dot := _dot.(*objects.DOT)
-		if !dot.IsAccess() {
+		if dot.IsAccess() != filter.access || !filter.accept(dot) {
+			trace.skip("doesn't grant " + filter.name)
+			continue
+		}
+		if expiry := dot.GetExpiry(); expiry != nil && expiry.Before(cutoff) {
+			trace.skip("expired or expiring within ExpiryGrace")
 			continue
 		}
-		if permset := dot.GetPermissionSet(); !permset.CanConsume {
+		if c.DOTFilter != nil && !c.DOTFilter(dot) {
+			trace.skip("rejected by DOTFilter")
 			continue
 		}
 		retDOTs = append(retDOTs, dot)
@@ -182,102 +1186,628 @@ func (c *Client) findDOTsFromVK(fromvk string) ([]*objects.DOT, error) {
 	return retDOTs, nil
 }
 
+// Finds all valid access chains from the namespace VK to our VK that grant consume permissions. The
+// chains are sorted by length, shortest first, and then by their DOT hashes
 func (c *Client) FindDOTChains(namespace string) ([]*objects.DChain, error) {
+	return c.findChains(context.Background(), namespace, canConsume)
+}
+
+// Same as FindDOTChains, but each chain is sent on the returned channel as soon as it has been found
+// and checked, so callers can start using the first chains before the search is over. The chains are
+// not sorted or cached. If the search fails, the error is sent on the error channel. Both channels are
+// closed when the search is done. Cancel ctx to stop the search early, e.g. when the caller stops
+// draining the chain channel; the search then fails with ctx's error
+func (c *Client) FindDOTChainsStream(ctx context.Context, namespace string) (<-chan *objects.DChain, <-chan error) {
+	out := make(chan *objects.DChain, 10)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(out)
+		namespace := canonicalVK(namespace)
+		var (
+			seenChains = make(map[string]struct{})
+			revoked    = make(map[string]bool)
+		)
+		_, err := c.findDOTChains(ctx, namespace, canonicalVK(c.vk), namespace, canConsume, nil, func(dots []*objects.DOT) (bool, error) {
+			key := dotsKey(dots)
+			if _, found := seenChains[key]; found {
+				return false, nil
+			}
+			seenChains[key] = struct{}{}
+			dchain, err := c.checkChain(ctx, dots, canConsume, revoked, nil)
+			if err != nil || dchain == nil {
+				return false, err
+			}
+			atomic.AddInt64(&c.Metrics.ChainsFound, 1)
+			select {
+			case out <- dchain:
+				return false, nil
+			case <-ctx.Done():
+				return true, ctx.Err()
+			}
+		})
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return out, errs
+}
+
+// Finds all valid permission chains from the namespace VK to our VK, i.e. chains of permission DOTs
+// that grant any permissions, rather than access chains. These are the chains that let us create
+// further DOTs. The chains are sorted like those of FindDOTChains
+func (c *Client) FindPermissionChains(namespace string) ([]*objects.DChain, error) {
+	return c.findChains(context.Background(), namespace, canDelegate)
+}
+
+// Finds all valid access chains on the namespace from fromvk to tovk that grant consume permissions.
+// FindDOTChains is the special case where fromvk is the namespace and tovk is our VK. Results from this
+// function are never cached, and are sorted like those of FindDOTChains
+func (c *Client) FindDOTChainsBetween(fromvk, tovk, namespace string) ([]*objects.DChain, error) {
+	return c.buildChains(context.Background(), fromvk, tovk, namespace, canConsume, nil)
+}
+
+// Returns the lists of DOTs FindDOTChains would build its chains from, without collapsing them into
+// DChains. Each list is ordered from the DOT granted by the namespace to the DOT granted to our VK, and
+// forms a potential consume chain: unlike FindDOTChains, the lists are not checked for revoked DOTs or
+// invalid signatures, and are not deduplicated, sorted or cached
+func (c *Client) FindAccessDOTs(namespace string) ([][]*objects.DOT, error) {
+	namespace = canonicalVK(namespace)
+	return c.findDOTChains(context.Background(), namespace, canonicalVK(c.vk), namespace, canConsume, nil, nil)
+}
+
+// finds all valid chains from the namespace VK to our VK built from DOTs that pass the filter
+func (c *Client) findChains(ctx context.Context, namespace string, filter permFilter) ([]*objects.DChain, error) {
+	namespace = canonicalVK(namespace)
+	if cached, found := c.getCachedChains(namespace, filter); found {
+		return cached, nil
+	}
+	dchains, err := c.buildChains(ctx, namespace, c.vk, namespace, filter, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.cacheChains(namespace, filter, dchains)
+	return dchains, nil
+}
+
+// finds all valid chains on the namespace from fromvk to tovk built from DOTs that pass the filter
+func (c *Client) buildChains(ctx context.Context, fromvk, tovk, namespace string, filter permFilter, trace *searchTrace) ([]*objects.DChain, error) {
+	// the search compares VKs as strings, so they must all be in the same encoding
+	fromvk, tovk, namespace = canonicalVK(fromvk), canonicalVK(tovk), canonicalVK(namespace)
 	var (
-		dchains    []*objects.DChain
-		visitedVKs = make(map[string]struct{})
+		dchains []*objects.DChain
+		// the same sequence of DOTs can be found more than once, e.g. if the registry returns a DOT twice
+		seenChains = make(map[string]struct{})
+		// DOT hash -> whether it has been revoked, so each DOT is only checked once
+		revoked = make(map[string]bool)
 	)
 	// get the list of lists of DOTs
-	dotlists, err := c.findDOTChains(namespace, c.vk, namespace, visitedVKs)
+	dotlists, err := c.findDOTChains(ctx, fromvk, tovk, namespace, filter, trace, nil)
 	if err != nil {
 		return nil, err
 	}
 	// for every list, collapse it into a DChain object
 	for _, chain := range dotlists {
-		dchain, err := objects.CreateDChain(true, chain...)
+		key := dotsKey(chain)
+		if _, found := seenChains[key]; found {
+			continue
+		}
+		seenChains[key] = struct{}{}
+		dchain, err := c.checkChain(ctx, chain, filter, revoked, trace)
 		if err != nil {
 			return nil, err
 		}
-		// skip the dchain if it is invalid or isn't an access chain
-		if !dchain.IsAccess() || !dchain.CheckAllSigs() {
-			continue
+		if dchain != nil {
+			dchains = append(dchains, dchain)
 		}
-
-		dchains = append(dchains, dchain)
 	}
-	return dchains, err
+	sortChains(dchains)
+	atomic.AddInt64(&c.Metrics.ChainsFound, int64(len(dchains)))
+	return dchains, nil
 }
 
-// find/build lists of DOTs between the two VKs on the given namespace
-func (c *Client) findDOTChains(fromvk, findvk, namespace string, visitedVKs map[string]struct{}) ([][]*objects.DOT, error) {
-	var (
-		chains [][]*objects.DOT
-	)
-	// mark start point as visited
-	visitedVKs[fromvk] = struct{}{}
-	dots, err := c.findDOTsFromVK(fromvk)
+// collapses a list of DOTs from the search into a DChain, returning nil if it isn't a valid chain of
+// the kind the filter is for. revoked is passed on to noneRevoked
+func (c *Client) checkChain(ctx context.Context, dots []*objects.DOT, filter permFilter, revoked map[string]bool, trace *searchTrace) (*objects.DChain, error) {
+	// a DOT may have been revoked since the registry listed it
+	if ok, err := c.noneRevoked(ctx, dots, revoked); err != nil {
+		return nil, err
+	} else if !ok {
+		trace.discard("contains a revoked DOT")
+		return nil, nil
+	}
+	dchain, err := objects.CreateDChain(filter.access, dots...)
 	if err != nil {
-		return chains, errors.Wrap(err, "Could not find DOTS from vk")
+		return nil, errors.Wrapf(err, "Could not build chain from DOTs %s", dotHashes(dots))
+	}
+	// skip the dchain if it is invalid or isn't the kind of chain we're after
+	if dchain.IsAccess() != filter.access {
+		trace.discard("not an access chain")
+		return nil, nil
+	}
+	if !dchain.CheckAllSigs() {
+		trace.discard("invalid signature")
+		return nil, nil
+	}
+	return dchain, nil
+}
+
+// sorts chains by length, shortest first, then by the concatenation of their DOT hashes, so that the
+// same chains always come back in the same order
+func sortChains(dchains []*objects.DChain) {
+	sort.Slice(dchains, func(i, j int) bool {
+		if ni, nj := dchains[i].NumHashes(), dchains[j].NumHashes(); ni != nj {
+			return ni < nj
+		}
+		return chainHashesKey(dchains[i]) < chainHashesKey(dchains[j])
+	})
+}
+
+// the concatenation of the DOT hashes of a chain
+func chainHashesKey(dchain *objects.DChain) string {
+	var key []byte
+	for i := 0; i < dchain.NumHashes(); i++ {
+		key = append(key, dchain.GetDotHash(i)...)
+	}
+	return string(key)
+}
+
+// Returns an identity for the chain: the base64 encoded SHA-256 of its DOT hashes in order. Two chains
+// have the same ChainHash exactly when ChainsEqual is true. Only the DOT hashes are used, so the chain
+// doesn't need to be elaborated
+func ChainHash(dchain *objects.DChain) string {
+	sum := sha256.Sum256([]byte(chainHashesKey(dchain)))
+	return fmtHash(sum[:])
+}
+
+// Returns true if the chains are made of the same DOTs in the same order
+func ChainsEqual(a, b *objects.DChain) bool {
+	if a.NumHashes() != b.NumHashes() {
+		return false
+	}
+	return chainHashesKey(a) == chainHashesKey(b)
+}
+
+// the hashes of the DOTs in order, for error messages
+func dotHashes(dots []*objects.DOT) string {
+	hashes := make([]string, len(dots))
+	for i, dot := range dots {
+		hashes[i] = fmtHash(dot.GetHash())
 	}
+	return strings.Join(hashes, " -> ")
+}
+
+// returns false if any of the DOTs has been revoked according to the registry. checked remembers
+// the answer for each DOT hash across calls. The lookups are retried like the rest of the search, see
+// LookupRetry
+func (c *Client) noneRevoked(ctx context.Context, dots []*objects.DOT, checked map[string]bool) (bool, error) {
 	for _, dot := range dots {
-		var our_chain []*objects.DOT
-		// check if the DOT is granted on the right namespace
-		mvk := fmtHash(dot.GetAccessURIMVK())
-		if mvk != namespace {
-			continue
+		hash := fmtHash(dot.GetHash())
+		revoked, found := checked[hash]
+		if !found {
+			var validity bw2.RegistryValidity
+			err := c.LookupRetry.do(ctx, func() (err error) {
+				_, validity, err = c.resolveRegistry(ctx, hash)
+				return err
+			})
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			if err != nil {
+				return false, errors.Wrapf(err, "Could not check revocation of DOT %s", hash)
+			}
+			revoked = validity == bw2.StateRevoked
+			checked[hash] = revoked
 		}
-		recvVK := fmtHash(dot.GetReceiverVK())
-		if _, found := visitedVKs[recvVK]; found {
-			continue
+		if revoked {
+			return false, nil
 		}
-		// add dot to the current chain
-		our_chain = append(our_chain, dot)
+	}
+	return true, nil
+}
 
-		// check if the DOT is granted to our VK. If it is, we terminate this branch of
-		// the search
-		if recvVK == findvk || recvVK == EVERYBODYVK {
-			chains = append(chains, our_chain)
-			continue
+// identifies a list of DOTs by the concatenation of their hashes, in order
+func dotsKey(dots []*objects.DOT) string {
+	var key []byte
+	for _, dot := range dots {
+		key = append(key, dot.GetHash()...)
+	}
+	return string(key)
+}
+
+// a partial chain in the search: path holds the DOTs leading from the start of the search to vk
+type searchState struct {
+	vk   string
+	path []*objects.DOT
+}
+
+// returns true if vk is on the path to this state, including the state itself
+func (st searchState) visited(vk string) bool {
+	if vk == st.vk {
+		return true
+	}
+	for _, dot := range st.path {
+		if fmtHash(dot.GetGiverVK()) == vk {
+			return true
 		}
+	}
+	return false
+}
 
-		// otherwise, we continue our search
-		// copy the map
-		newvisited := make(map[string]struct{})
-		for k, v := range visitedVKs {
-			newvisited[k] = v
+// find/build lists of DOTs between the two VKs on the given namespace. The search is breadth first: the
+// frontier holds every partial chain of the current length. A DOT granting back to a VK already on its
+// path would form a cycle and is not followed, but separate paths may pass through the same VK. We don't
+// build chains longer than c.MaxChainLength. If findvk is empty, every chain starting at fromvk is returned,
+// whatever VK it ends at. If trace is non-nil, it records why branches of the search were abandoned. If
+// until is non-nil, it is called with each chain that reaches findvk, and the search stops early once it
+// returns true or an error
+func (c *Client) findDOTChains(ctx context.Context, fromvk, findvk, namespace string, filter permFilter, trace *searchTrace, until func([]*objects.DOT) (bool, error)) ([][]*objects.DOT, error) {
+	var (
+		chains   [][]*objects.DOT
+		frontier = []searchState{{vk: fromvk}}
+		// converging paths share the lookups, but not the chains built from them: which DOTs can be
+		// followed from a VK depends on the path that led there, because of the visited check
+		memo = make(map[string][]*objects.DOT)
+	)
+	for depth := 1; len(frontier) > 0; depth++ {
+		if err := ctx.Err(); err != nil {
+			return chains, err
 		}
-		recursive_chains, err := c.findDOTChains(recvVK, findvk, namespace, newvisited)
+		dotsets, err := c.expandFrontier(ctx, frontier, filter, memo, trace)
 		if err != nil {
 			return chains, err
 		}
-		for _, chain := range recursive_chains {
-			chains = append(chains, append(our_chain, chain...))
+		var next []searchState
+		for i, st := range frontier {
+			before := len(chains) + len(next)
+			for _, dot := range dotsets[i] {
+				atomic.AddInt64(&c.Metrics.DOTsExamined, 1)
+				// check if the DOT is granted on the right namespace
+				if filter.access && fmtHash(dot.GetAccessURIMVK()) != namespace {
+					trace.skip("granted on another namespace")
+					continue
+				}
+				recvVK := fmtHash(dot.GetReceiverVK())
+				// this VK is already on our path, so following the DOT would loop
+				if st.visited(recvVK) {
+					trace.skip("would form a cycle")
+					continue
+				}
+				// copy the path so that sibling branches don't share a backing array
+				path := make([]*objects.DOT, len(st.path), len(st.path)+1)
+				copy(path, st.path)
+				path = append(path, dot)
+
+				// check if the DOT is granted to our VK. If it is, we terminate this branch of
+				// the search
+				if recvVK == findvk || recvVK == EVERYBODYVK {
+					chains = append(chains, path)
+					if until != nil {
+						if done, err := until(path); err != nil || done {
+							return chains, err
+						}
+					}
+					continue
+				}
+				// when we're not looking for anyone in particular, every partial chain counts
+				if findvk == "" {
+					chains = append(chains, path)
+				}
+				// otherwise, we continue our search unless the chain would get too long
+				if c.MaxChainLength > 0 && depth >= c.MaxChainLength {
+					trace.skip("chain would exceed MaxChainLength")
+					continue
+				}
+				next = append(next, searchState{vk: recvVK, path: path})
+			}
+			if len(chains)+len(next) == before {
+				trace.deadEnd(st.vk)
+			}
 		}
+		frontier = next
 	}
 	return chains, nil
 }
 
+// looks up the DOTs granted from the VK of each state in the frontier, with at most
+// MaxConcurrentLookups lookups in flight. The result is in the same order as the frontier. memo holds
+// the DOTs of every VK looked up so far in this search; each VK is only looked up once, however many
+// paths reach it
+func (c *Client) expandFrontier(ctx context.Context, frontier []searchState, filter permFilter, memo map[string][]*objects.DOT, trace *searchTrace) ([][]*objects.DOT, error) {
+	var (
+		missing []string
+		wanted  = make(map[string]struct{})
+	)
+	for _, st := range frontier {
+		if _, found := memo[st.vk]; found {
+			continue
+		}
+		if _, found := wanted[st.vk]; !found {
+			wanted[st.vk] = struct{}{}
+			missing = append(missing, st.vk)
+		}
+	}
+
+	var (
+		found   = make([][]*objects.DOT, len(missing))
+		errs    = make([]error, len(missing))
+		wg      sync.WaitGroup
+		lookups = c.MaxConcurrentLookups
+	)
+	if lookups < 1 {
+		lookups = 1
+	}
+	tokens := make(chan struct{}, lookups)
+	wg.Add(len(missing))
+	for i, vk := range missing {
+		tokens <- struct{}{}
+		go func(i int, vk string) {
+			defer wg.Done()
+			found[i], errs[i] = c.findDOTsFromVK(ctx, vk, filter, trace)
+			<-tokens
+		}(i, vk)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not find DOTS from vk")
+		}
+	}
+	for i, vk := range missing {
+		// a VK with no DOTs is remembered too, as an empty slice
+		if found[i] == nil {
+			found[i] = []*objects.DOT{}
+		}
+		memo[vk] = found[i]
+	}
+
+	dotsets := make([][]*objects.DOT, len(frontier))
+	for i, st := range frontier {
+		dotsets[i] = memo[st.vk]
+	}
+	return dotsets, nil
+}
+
+// Returned (wrapped) by GetDChainURIErr when a DOT in the chain grants nothing on the requested URI
+var ErrNoOverlap = errors.New("DOT chain does not overlap URI")
+
 // given a dchain and a URI, return the broadest URI you can actually
-// subscribe to using the dchain. Assumes the DChain is elaborated (i.e. it has
-// all of its DOTs populated)
+// subscribe to using the dchain. The DChain must be elaborated (i.e. it has
+// all of its DOTs populated; see Client.ResolveDChainURI otherwise). Returns ""
+// if the dchain doesn't overlap the URI or isn't elaborated; use GetDChainURIErr
+// to find out why. A URI that is only a namespace refers to
+// the namespace root, which only chains granting the whole namespace ("*") reach,
+// and is returned without a trailing slash
 func GetDChainURI(dchain *objects.DChain, uri string) string {
+	subURI, err := GetDChainURIErr(dchain, uri)
+	if err != nil {
+		return ""
+	}
+	return subURI
+}
+
+// Same as GetDChainURI, but returns an error wrapping ErrNoOverlap naming the DOT that
+// doesn't overlap the URI instead of an empty string
+func GetDChainURIErr(dchain *objects.DChain, uri string) (string, error) {
+	suffix, err := restrictURISuffix(dchain, uri)
+	if err != nil {
+		return "", err
+	}
+	return joinURI(uriNamespace(uri), suffix), nil
+}
+
+// joins a namespace and a URI suffix. An empty suffix is the root of the namespace, which is the
+// namespace alone without a trailing slash
+func joinURI(ns, suffix string) string {
+	if suffix == "" {
+		return ns
+	}
+	return ns + "/" + suffix
+}
+
+// Same as GetDChainURI, but returns only the restricted URI suffix, without the namespace. The boolean
+// is false if the chain doesn't overlap the URI
+func GetDChainURISuffix(dchain *objects.DChain, uri string) (string, bool) {
+	suffix, err := restrictURISuffix(dchain, uri)
+	return suffix, err == nil
+}
+
+// restricts the suffix of the URI by each DOT in the chain in turn
+func restrictURISuffix(dchain *objects.DChain, uri string) (string, error) {
 	subURI := GetURISuffix(uri)
-	ns := strings.Split(uri, "/")[0]
+	ns := uriNamespace(uri)
 	// collapse the DOT to get the actual subscription URI
 	for i := 0; i < dchain.NumHashes(); i++ {
 		dot := dchain.GetDOT(i)
-		newURI, overlap := util.RestrictBy(dot.GetAccessURISuffix(), subURI)
+		if dot == nil {
+			return "", notElaborated(dchain)
+		}
+		var newURI string
+		var overlap bool
+		if subURI == "" {
+			// the namespace root is only matched by a DOT on the whole namespace, since '*' matches zero
+			// or more segments. Restricting it doesn't change it
+			overlap = dot.GetAccessURISuffix() == "*"
+		} else {
+			newURI, overlap = RestrictURI(dot.GetAccessURISuffix(), subURI)
+		}
 		// if it don't overlap, don't use it
 		if !overlap {
-			return ""
+			return "", errors.Wrapf(ErrNoOverlap, "DOT %s grants %s, requested %s", fmtHash(dot.GetHash()), dot.GetAccessURISuffix(), subURI)
 		}
 		subURI = newURI
 	}
 
-	return ns + "/" + subURI
+	// RestrictBy works on patterns, so make sure what's left is still something we can subscribe to, and
+	// that it matches the same or fewer resources than the requested URI
+	if err := ValidateURI(joinURI(ns, subURI)); err != nil {
+		return "", errors.Wrapf(err, "DOT chain restricts %s to an invalid URI", uri)
+	}
+	if !uriContains(GetURISuffix(uri), subURI) {
+		return "", fmt.Errorf("DOT chain restricts %s to %s, which is broader", uri, joinURI(ns, subURI))
+	}
+	return subURI, nil
 }
 
-// Returns the URI that's not the namespace
+// returns the chains that haven't exceeded their TTL and whose permissions as a whole (see ChainPermissions)
+// still pass the access filter
+func liveChains(dchains []*objects.DChain, filter permFilter) []*objects.DChain {
+	var live []*objects.DChain
+	for _, dchain := range dchains {
+		if dchain.GetTTL() < 0 {
+			continue
+		}
+		if perms, err := ChainPermissions(dchain); err != nil || !filter.grants(perms) {
+			continue
+		}
+		live = append(live, dchain)
+	}
+	return live
+}
+
+// finds the unexpired, non-redundant chains from the namespace of the URI to our VK that grant the
+// filtered permissions, along with the effective URI of each chain. If vkFilter is non-nil, only chains
+// it keeps are considered. If selector is non-nil, only the chains it picks are returned. The usable
+// chains that don't overlap the URI at all are returned separately. If the namespace is ours there are
+// no DOTs to find, and the only chain returned is nil, on the whole URI
+func (c *Client) usableChains(ctx context.Context, uri string, filter permFilter, vkFilter *VKFilter, selector ChainSelector) ([]*objects.DChain, []string, []*objects.DChain, error) {
+	return c.usableChainsFrom(ctx, nil, uri, filter, vkFilter, selector)
+}
+
+// where the chains on a namespace come from: findChains, unless a caller shares them between lookups
+type chainSource func(ctx context.Context, nsvk string, filter permFilter) ([]*objects.DChain, error)
+
+// same as usableChains, but takes the chains on the namespace from source, or from findChains if it is nil
+func (c *Client) usableChainsFrom(ctx context.Context, source chainSource, uri string, filter permFilter, vkFilter *VKFilter, selector ChainSelector) ([]*objects.DChain, []string, []*objects.DChain, error) {
+	if source == nil {
+		source = c.findChains
+	}
+	// get NSVK for URI
+	nsvk, err := c.GetNamespaceVKContext(ctx, uri)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "Could not resolve namespace")
+	}
+	if c.ownsNamespace(nsvk) {
+		return []*objects.DChain{nil}, []string{uri}, nil, nil
+	}
+
+	_dchains, err := source(ctx, nsvk, filter)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "Could not find DOT chains")
+	}
+	dchains, uris, skipped := c.pickChains(_dchains, uri, filter, vkFilter, selector)
+	return dchains, uris, skipped, nil
+}
+
+// narrows down the chains found on the namespace of the URI to the ones usableChains returns, along
+// with their effective URIs and the chains that don't overlap the URI
+func (c *Client) pickChains(_dchains []*objects.DChain, uri string, filter permFilter, vkFilter *VKFilter, selector ChainSelector) ([]*objects.DChain, []string, []*objects.DChain) {
+	// drop unusable chains, then set aside the chains that don't overlap the URI
+	var overlapping, skipped []*objects.DChain
+	for _, dchain := range liveChains(_dchains, filter) {
+		if vkFilter != nil && !vkFilter.keep(dchain) {
+			continue
+		}
+		if _, ok := GetDChainURISuffix(dchain, uri); !ok {
+			skipped = append(skipped, dchain)
+			continue
+		}
+		overlapping = append(overlapping, dchain)
+	}
+	// then drop any chain whose URI is covered by another chain
+	dchains := PruneRedundantChains(overlapping, uri)
+	atomic.AddInt64(&c.Metrics.ChainsPruned, int64(len(overlapping)-len(dchains)))
+	if selector != nil {
+		dchains = selector(dchains)
+	}
+	uris := make([]string, len(dchains))
+	for i, dchain := range dchains {
+		uris[i] = GetDChainURI(dchain, uri)
+	}
+	return dchains, uris, skipped
+}
+
+// Given a set of dchains and the URI we want to subscribe to, returns the subset of dchains we actually need to
+// cover the URI. Chains that don't overlap the URI at all are dropped, as is any chain whose effective URI
+// (from GetDChainURI) is fully contained in the effective URI of another chain. If several chains have the
+// same effective URI, only one is kept: the one with the largest TTL, then the shortest, then the first.
+// The order of the input is preserved
+func PruneRedundantChains(chains []*objects.DChain, uri string) []*objects.DChain {
+	var (
+		pruned   []*objects.DChain
+		suffixes []string
+	)
+	for _, dchain := range chains {
+		suffix, ok := GetDChainURISuffix(dchain, uri)
+		if !ok {
+			pruned = append(pruned, nil)
+			suffixes = append(suffixes, "")
+			continue
+		}
+		pruned = append(pruned, dchain)
+		suffixes = append(suffixes, suffix)
+	}
+
+	var ret []*objects.DChain
+	for i, dchain := range pruned {
+		if dchain == nil {
+			continue
+		}
+		redundant := false
+		for j, other := range pruned {
+			if i == j || other == nil || !uriContains(suffixes[j], suffixes[i]) {
+				continue
+			}
+			// identical URIs contain each other, so only let the preferred chain win
+			if suffixes[i] != suffixes[j] || preferChain(other, dchain, j < i) {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			ret = append(ret, dchain)
+		}
+	}
+	return ret
+}
+
+// returns true if chain a should be used instead of chain b when both give the same URI: it has the
+// larger TTL, or the same TTL and fewer DOTs. If they are equally good, aFirst decides
+func preferChain(a, b *objects.DChain, aFirst bool) bool {
+	if a.GetTTL() != b.GetTTL() {
+		return a.GetTTL() > b.GetTTL()
+	}
+	if a.NumHashes() != b.NumHashes() {
+		return a.NumHashes() < b.NumHashes()
+	}
+	return aFirst
+}
+
+// returns true if every resource matched by the URI suffix inner is also matched by outer
+func uriContains(outer, inner string) bool {
+	// covers the namespace root, which RestrictURI doesn't handle
+	if outer == inner {
+		return true
+	}
+	restricted, overlap := RestrictURI(inner, outer)
+	return overlap && restricted == inner
+}
+
+// Returns the URI that's not the namespace. This is empty if the URI is only a namespace
 func GetURISuffix(uri string) string {
 	return strings.Join(strings.Split(uri, "/")[1:], "/")
 }
+
+// Returns the namespace token of the URI as written, before any resolution, so it may be an alias or
+// a VK. This is empty if the URI is not valid
+func GetURINamespace(uri string) string {
+	if ValidateURI(uri) != nil {
+		return ""
+	}
+	return uriNamespace(uri)
+}
+
+// the first segment of the URI, without validating it
+func uriNamespace(uri string) string {
+	return strings.Split(uri, "/")[0]
+}
@@ -0,0 +1,705 @@
+package bw2util
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/objects"
+	bw2 "github.com/immesys/bw2bind"
+	"github.com/pkg/errors"
+)
+
+func TestNewClientFromBackend(t *testing.T) {
+	if _, err := newClientFromBackend(newFakeBackend(), ""); err == nil {
+		t.Fatal("expected an error for an empty VK")
+	}
+
+	w := newTestWorld(t)
+	dot := w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	dchains, err := w.c.FindDOTChains(vkOf(w.ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dchains) != 1 || dchains[0].NumHashes() != 1 || fmtHash(dchains[0].GetDotHash(0)) != fmtHash(dot.GetHash()) {
+		t.Fatalf("expected the single DOT chain, got %d chains", len(dchains))
+	}
+}
+
+func TestContentDeduper(t *testing.T) {
+	d := newContentDeduper(time.Minute)
+	if !d.isNew(testMessage("ns/a1", "sig1", testPO{2 << 24, []byte("x")})) {
+		t.Fatal("first message should be new")
+	}
+	// the same bytes split differently between the URI and the PO number
+	if !d.isNew(testMessage("ns/a", "sig2", testPO{12 << 24, []byte("x")})) {
+		t.Fatal("message on a different URI with a different PO was dropped")
+	}
+	if !d.isNew(testMessage("ns/b", "sig3", testPO{2 << 24, []byte("x")})) {
+		t.Fatal("identical payload on a different URI was dropped")
+	}
+	if d.isNew(testMessage("ns/a1", "sig4", testPO{2 << 24, []byte("x")})) {
+		t.Fatal("identical message on the same URI was not dropped")
+	}
+}
+
+func TestDedupKeepsSignatureCheck(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	uri := "test.ns/a"
+	// a signature seen before is a duplicate even if the content deduper hasn't seen the contents
+	w.bw.messages[uri] = []*bw2.SimpleMessage{
+		testMessage(uri, "sig1", testPO{2 << 24, []byte("x")}),
+		testMessage(uri, "sig1", testPO{2 << 24, []byte("y")}),
+		testMessage(uri, "sig2", testPO{2 << 24, []byte("z")}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs, err := w.c.MultiSubscribeWithParams(ctx, &MultiSubscribeParams{URI: uri, Dedup: true, SkipQuery: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"sig1", "sig2"} {
+		select {
+		case msg := <-msgs:
+			if string(msg.Signature) != want {
+				t.Fatalf("got message %s, want %s", msg.Signature, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+	cancel()
+	if extra := drain(t, msgs); len(extra) != 0 {
+		t.Fatalf("got %d duplicate messages", len(extra))
+	}
+}
+
+func TestMultiSubscribeSkipsNonOverlappingChains(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "a/*", "C")
+	w.bw.grant(w.ns, w.me, w.ns, "b/*", "C")
+	sub, err := w.c.MultiSubscribeHandle(context.Background(), &MultiSubscribeParams{URI: "test.ns/a/x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uris := sub.URIs(); len(uris) != 1 || uris[0] != "test.ns/a/x" {
+		t.Fatalf("subscribed to %v, want only test.ns/a/x", uris)
+	}
+	if skipped := sub.Skipped(); len(skipped) != 1 || errors.Cause(skipped[0].Err) != ErrNoOverlap {
+		t.Fatalf("got skipped %v, want one ErrNoOverlap", skipped)
+	}
+	if got := w.bw.subscribedURIs(); len(got) != 1 || got[0] != "test.ns/a/x" {
+		t.Fatalf("agent saw subscriptions to %v", got)
+	}
+	msgs, uris, err := w.c.MultiSubscribeVerbose("test.ns/a/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uris) != 1 || uris[0] != "test.ns/a/x" {
+		t.Fatalf("MultiSubscribeVerbose subscribed to %v, want only test.ns/a/x", uris)
+	}
+
+	// with no overlapping chain at all, the skipped chains are the error
+	_, _, err = w.c.MultiSubscribeVerbose("test.ns/c")
+	if merr, ok := err.(MultiError); !ok || len(merr) != 2 || errors.Cause(merr[0].(*ChainError).Err) != ErrNoOverlap {
+		t.Fatalf("got %v, want a MultiError of two ErrNoOverlap", err)
+	}
+	w.c.Close()
+	drain(t, sub.C)
+	drain(t, msgs)
+}
+
+func TestFindAccessDOTsWithStdVK(t *testing.T) {
+	bw := newFakeBackend()
+	ns, me := newEntity(), newStdEntity()
+	bw.grant(ns, me, ns, "*", "C")
+	c, err := newClientFromBackend(bw, base64.StdEncoding.EncodeToString(me.GetVK()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lists, err := c.FindAccessDOTs(vkOf(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 1 {
+		t.Fatalf("got %d DOT lists, want 1", len(lists))
+	}
+}
+
+func TestFindDOTChainsStream(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "a/*", "C")
+	w.bw.grant(w.ns, w.me, w.ns, "b/*", "C")
+	out, errs := w.c.FindDOTChainsStream(context.Background(), vkOf(w.ns))
+	var got int
+	for range out {
+		got++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("got %d chains, want 2", got)
+	}
+}
+
+func TestFindDOTChainsStreamCancel(t *testing.T) {
+	w := newTestWorld(t)
+	// more chains than the stream buffers, so the search blocks if nobody reads them
+	for i := 0; i < 20; i++ {
+		w.bw.grant(w.ns, w.me, w.ns, fmt.Sprintf("%d/*", i), "C")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	out, errs := w.c.FindDOTChainsStream(ctx, vkOf(w.ns))
+	<-out
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("search still running after the context was cancelled")
+	}
+	for range out {
+	}
+}
+
+func TestOwnNamespace(t *testing.T) {
+	w := newTestWorld(t)
+	c, err := newClientFromBackend(w.bw, vkOf(w.ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	uri := "test.ns/a/b"
+	w.bw.messages[uri] = []*bw2.SimpleMessage{testMessage(uri, "sig", testPO{ponum: 1})}
+
+	for name, can := range map[string]func(string) (bool, error){"CanSubscribe": c.CanSubscribe, "CanPublish": c.CanPublish} {
+		if ok, err := can(uri); err != nil || !ok {
+			t.Errorf("%s: got %v, %v, want true", name, ok, err)
+		}
+	}
+	if err := c.MultiPublish(uri, testPO{ponum: 1}); err != nil {
+		t.Errorf("MultiPublish: %v", err)
+	}
+	if dchain, err := c.PublishOnBestChain(uri, testPO{ponum: 1}); err != nil || dchain != nil {
+		t.Errorf("PublishOnBestChain: got %v, %v, want no chain", dchain, err)
+	}
+	if msgs, err := c.MultiQuery(uri); err != nil || len(msgs) != 1 {
+		t.Errorf("MultiQuery: got %d messages and %v, want 1", len(msgs), err)
+	}
+	if dchain, err := c.FindCommonChain([]string{uri, "test.ns/c"}); err != nil || dchain != nil {
+		t.Errorf("FindCommonChain: got %v, %v, want no chain", dchain, err)
+	}
+	plans, err := c.MultiSubscribePlan(uri)
+	if err != nil || len(plans) != 1 || plans[0].Chain != nil || !plans[0].Permissions.CanConsume {
+		t.Errorf("MultiSubscribePlan: got %+v, %v, want one plan without a chain", plans, err)
+	}
+	msgs, err := c.MultiSubscribe(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-msgs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message from MultiSubscribe")
+	}
+
+	if len(w.bw.lookups) != 0 {
+		t.Errorf("searched for chains %d times in our own namespace", len(w.bw.lookups))
+	}
+	for _, p := range w.bw.publishes {
+		if p.RoutingObjects != nil {
+			t.Errorf("published with routing objects %v", p.RoutingObjects)
+		}
+	}
+	for _, p := range w.bw.subscribes {
+		if p.RoutingObjects != nil {
+			t.Errorf("subscribed with routing objects %v", p.RoutingObjects)
+		}
+	}
+	for _, p := range w.bw.queries {
+		if p.RoutingObjects != nil {
+			t.Errorf("queried with routing objects %v", p.RoutingObjects)
+		}
+	}
+}
+
+func TestMultiSubscribeAllSearchesOnce(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	msgs, err := w.c.MultiSubscribeAll([]string{"test.ns/a", "test.ns/b", "test.ns/c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.bw.lookups) != 1 {
+		t.Errorf("searched the namespace with %d lookups, want 1", len(w.bw.lookups))
+	}
+	if got := w.bw.subscribedURIs(); len(got) != 3 {
+		t.Errorf("subscribed to %v, want 3 URIs", got)
+	}
+	w.c.Close()
+	drain(t, msgs)
+}
+
+func TestMultiSubscribeNamespaces(t *testing.T) {
+	w := newTestWorld(t)
+	other := newEntity()
+	w.bw.alias("other.ns", other)
+	w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	w.bw.grant(other, w.me, other, "*", "C")
+	msgs, err := w.c.MultiSubscribeNamespaces([]string{"test.ns", "other.ns"}, "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := w.bw.subscribedURIs()
+	if len(got) != 2 || got[0] != "other.ns/a/b" || got[1] != "test.ns/a/b" {
+		t.Errorf("subscribed to %v, want other.ns/a/b and test.ns/a/b", got)
+	}
+	w.c.Close()
+	drain(t, msgs)
+}
+
+func TestMultiSubscribeReconnect(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	uri := "test.ns/a"
+	w.bw.messages[uri] = []*bw2.SimpleMessage{testMessage(uri, "second", testPO{ponum: 1})}
+	// the first subscription is dropped by the agent after one message, so the chain's goroutine has to
+	// go back to the client to subscribe again
+	dropped := false
+	w.bw.subscribeFn = func(p *bw2.SubscribeParams) (chan *bw2.SimpleMessage, string, error) {
+		if dropped {
+			return w.bw.liveSubscribe(p)
+		}
+		dropped = true
+		msgs := make(chan *bw2.SimpleMessage, 1)
+		msgs <- testMessage(uri, "first", testPO{ponum: 1})
+		close(msgs)
+		return msgs, "dropped", nil
+	}
+	// and the query finds nothing, so the second message can only come from the new subscription
+	w.bw.queryFn = func(p *bw2.QueryParams) (chan *bw2.SimpleMessage, error) {
+		msgs := make(chan *bw2.SimpleMessage)
+		close(msgs)
+		return msgs, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	params := &MultiSubscribeParams{URI: uri, Reconnect: true, ReconnectBackoff: time.Millisecond}
+	msgs, err := w.c.MultiSubscribeWithParams(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for len(got) < 2 {
+		select {
+		case msg := <-msgs:
+			got[string(msg.Signature)] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only got %v before timing out", got)
+		}
+	}
+	cancel()
+	drain(t, msgs)
+	if len(w.bw.subscribes) != 2 {
+		t.Errorf("subscribed %d times, want 2", len(w.bw.subscribes))
+	}
+	if len(w.bw.queries) != 1 {
+		t.Errorf("queried %d times, want 1", len(w.bw.queries))
+	}
+}
+
+func TestFindDOTChainsCycle(t *testing.T) {
+	w := newTestWorld(t)
+	a, b := newEntity(), newEntity()
+	w.bw.grant(w.ns, a, w.ns, "*", "C")
+	w.bw.grant(a, b, w.ns, "*", "C")
+	w.bw.grant(b, a, w.ns, "*", "C")
+	w.bw.grant(b, w.me, w.ns, "*", "C")
+	w.c.MaxChainLength = 0
+
+	done := make(chan struct{})
+	var (
+		dchains []*objects.DChain
+		err     error
+	)
+	go func() {
+		defer close(done)
+		dchains, err = w.c.FindDOTChains(vkOf(w.ns))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("search did not terminate on a cycle")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dchains) != 1 || dchains[0].NumHashes() != 3 {
+		t.Errorf("got %d chains, want the single chain ns -> A -> B -> me", len(dchains))
+	}
+}
+
+func TestGetNamespaceVKNotAnEntity(t *testing.T) {
+	w := newTestWorld(t)
+	dot := w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	w.bw.entries["dot.ns"] = dot
+	nsvk, err := w.c.GetNamespaceVK("dot.ns/a")
+	if err == nil {
+		t.Fatalf("resolved a DOT to namespace VK %s", nsvk)
+	}
+	if !strings.Contains(err.Error(), "not an entity") {
+		t.Errorf("got %v, want an error saying the namespace is not an entity", err)
+	}
+	// the failure isn't cached
+	w.bw.alias("dot.ns", w.ns)
+	if nsvk, err := w.c.GetNamespaceVK("dot.ns/a"); err != nil || nsvk != vkOf(w.ns) {
+		t.Errorf("got %s, %v after fixing the alias, want %s", nsvk, err, vkOf(w.ns))
+	}
+}
+
+func TestGetDChainURI(t *testing.T) {
+	w := newTestWorld(t)
+	a := newEntity()
+	for _, tc := range []struct {
+		uri      string
+		suffixes []string
+		want     string
+	}{
+		{"test.ns/*/!meta/giles", []string{"*"}, "test.ns/*/!meta/giles"},
+		{"test.ns/*/!meta/giles", []string{"a/*"}, "test.ns/a/*/!meta/giles"},
+		{"test.ns/*/!meta/giles", []string{"a/+/!meta/giles"}, "test.ns/a/+/!meta/giles"},
+		{"test.ns/*/!meta/giles", []string{"a/b"}, ""},
+		{"test.ns/a/+/b", []string{"*"}, "test.ns/a/+/b"},
+		{"test.ns/a/+/b", []string{"a/x/*"}, "test.ns/a/x/b"},
+		{"test.ns/a/+/b", []string{"a/*/c"}, ""},
+		{"test.ns/*", []string{"*"}, "test.ns/*"},
+		{"test.ns/*", []string{"a/+"}, "test.ns/a/+"},
+		{"test.ns/*", []string{"a/*", "*/b"}, "test.ns/a/*/b"},
+		{"test.ns", []string{"*"}, "test.ns"},
+		{"test.ns", []string{"a/*"}, ""},
+	} {
+		var dots []*objects.DOT
+		from := w.ns
+		for i, suffix := range tc.suffixes {
+			to := a
+			if i == len(tc.suffixes)-1 {
+				to = w.me
+			}
+			dots = append(dots, w.bw.grant(from, to, w.ns, suffix, "C"))
+			from = to
+		}
+		got := GetDChainURI(testChain(t, dots...), tc.uri)
+		if got != tc.want {
+			t.Errorf("GetDChainURI(%v, %s) = %q, want %q", tc.suffixes, tc.uri, got, tc.want)
+			continue
+		}
+		// the chain's URI never matches anything the requested one doesn't
+		if got != "" && !uriContains(GetURISuffix(tc.uri), GetURISuffix(got)) {
+			t.Errorf("GetDChainURI(%v, %s) = %s, which is broader than requested", tc.suffixes, tc.uri, got)
+		}
+	}
+}
+
+func TestFindDOTChainsDiamond(t *testing.T) {
+	w := newTestWorld(t)
+	a, b, c := newEntity(), newEntity(), newEntity()
+	w.bw.grant(w.ns, a, w.ns, "*", "C")
+	w.bw.grant(w.ns, b, w.ns, "*", "C")
+	w.bw.grant(a, c, w.ns, "*", "C")
+	w.bw.grant(b, c, w.ns, "*", "C")
+	last := w.bw.grant(c, w.me, w.ns, "*", "C")
+
+	dchains, err := w.c.FindDOTChains(vkOf(w.ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dchains) != 2 {
+		t.Fatalf("got %d chains through the diamond, want 2", len(dchains))
+	}
+
+	// the registry listing a DOT twice makes both paths through it identical
+	w.bw.add(last)
+	dchains, err = w.c.FindDOTChains(vkOf(w.ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dchains) != 2 {
+		t.Errorf("got %d chains with a duplicated DOT, want 2", len(dchains))
+	}
+}
+
+func TestFindDOTChainsIdenticalPaths(t *testing.T) {
+	w := newTestWorld(t)
+	a := newEntity()
+	w.bw.add(w.bw.grant(w.ns, a, w.ns, "*", "C"))
+	w.bw.grant(a, w.me, w.ns, "*", "C")
+	dchains, err := w.c.FindDOTChains(vkOf(w.ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dchains) != 1 {
+		t.Errorf("got %d chains from two identical paths, want 1", len(dchains))
+	}
+}
+
+// a namespace granting to width intermediate VKs, each of which grants to us, with a slow registry
+func newWideWorld(b *testing.B, width int) *testWorld {
+	w := newTestWorld(b)
+	w.bw.lookupDelay = time.Millisecond
+	for i := 0; i < width; i++ {
+		mid := newEntity()
+		w.bw.grant(w.ns, mid, w.ns, "*", "C")
+		w.bw.grant(mid, w.me, w.ns, "*", "C")
+	}
+	return w
+}
+
+func BenchmarkFindDOTChains(b *testing.B) {
+	const width = 32
+	for _, lookups := range []int{1, 8, width} {
+		b.Run(fmt.Sprintf("MaxConcurrentLookups=%d", lookups), func(b *testing.B) {
+			w := newWideWorld(b, width)
+			w.c.MaxConcurrentLookups = lookups
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dchains, err := w.c.FindDOTChains(vkOf(w.ns))
+				if err != nil || len(dchains) != width {
+					b.Fatalf("got %d chains and %v, want %d", len(dchains), err, width)
+				}
+			}
+		})
+	}
+}
+
+func TestGetNamespaceVKForms(t *testing.T) {
+	w := newTestWorld(t)
+	nsvk, err := w.c.GetNamespaceVK(vkOf(w.ns) + "/a/b")
+	if err != nil || nsvk != vkOf(w.ns) {
+		t.Errorf("raw VK: got %s, %v, want %s", nsvk, err, vkOf(w.ns))
+	}
+	if len(w.bw.resolves) != 0 {
+		t.Errorf("raw VK: resolved %v in the registry, want no lookups", w.bw.resolves)
+	}
+
+	for i := 0; i < 2; i++ {
+		nsvk, err = w.c.GetNamespaceVK("test.ns/a/b")
+		if err != nil || nsvk != vkOf(w.ns) {
+			t.Errorf("alias: got %s, %v, want %s", nsvk, err, vkOf(w.ns))
+		}
+	}
+	if len(w.bw.resolves) != 1 || w.bw.resolves[0] != "test.ns" {
+		t.Errorf("alias: resolved %v in the registry, want test.ns once", w.bw.resolves)
+	}
+}
+
+func TestGetDChainURISuffixConsistent(t *testing.T) {
+	w := newTestWorld(t)
+	var dchains []*objects.DChain
+	for _, suffix := range []string{"*", "a/*", "a/+/c", "b"} {
+		dchains = append(dchains, testChain(t, w.bw.grant(w.ns, w.me, w.ns, suffix, "C")))
+	}
+	for _, dchain := range dchains {
+		for _, uri := range []string{"test.ns", "test.ns/*", "test.ns/a/b/c", "test.ns/a/+/+", "test.ns/b"} {
+			full := GetDChainURI(dchain, uri)
+			suffix, ok := GetDChainURISuffix(dchain, uri)
+			if ok != (full != "") {
+				t.Errorf("%s on %s: GetDChainURI = %q but GetDChainURISuffix overlaps = %v", dchain.GetDOT(0).GetAccessURISuffix(), uri, full, ok)
+				continue
+			}
+			if ok && joinURI("test.ns", suffix) != full {
+				t.Errorf("%s on %s: GetDChainURI = %s but GetDChainURISuffix = %s", dchain.GetDOT(0).GetAccessURISuffix(), uri, full, suffix)
+			}
+		}
+	}
+}
+
+func TestNamespaceOnlyURIs(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.alias("scratch.ns", w.ns)
+	whole := testChain(t, w.bw.grant(w.ns, w.me, w.ns, "*", "C"))
+	for _, tc := range []struct {
+		uri    string
+		ok     bool
+		suffix string
+		subURI string
+	}{
+		{"scratch.ns", true, "", "scratch.ns"},
+		{"scratch.ns/", false, "", ""},
+		{"scratch.ns/a/b", true, "a/b", "scratch.ns/a/b"},
+	} {
+		nsvk, err := w.c.GetNamespaceVK(tc.uri)
+		if (err == nil) != tc.ok {
+			t.Errorf("GetNamespaceVK(%q) = %s, %v, want ok = %v", tc.uri, nsvk, err, tc.ok)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		if nsvk != vkOf(w.ns) {
+			t.Errorf("GetNamespaceVK(%q) = %s, want %s", tc.uri, nsvk, vkOf(w.ns))
+		}
+		if suffix := GetURISuffix(tc.uri); suffix != tc.suffix {
+			t.Errorf("GetURISuffix(%q) = %q, want %q", tc.uri, suffix, tc.suffix)
+		}
+		if subURI := GetDChainURI(whole, tc.uri); subURI != tc.subURI {
+			t.Errorf("GetDChainURI(%q) = %q, want %q", tc.uri, subURI, tc.subURI)
+		}
+	}
+}
+
+func TestMultiSubscribeCollapsesEqualURIs(t *testing.T) {
+	w := newTestWorld(t)
+	a := newEntity()
+	direct := w.bw.grant(w.ns, w.me, w.ns, "a/*", "C")
+	w.bw.grant(w.ns, a, w.ns, "*", "C")
+	w.bw.grant(a, w.me, w.ns, "a/*", "C")
+	msgs, err := w.c.MultiSubscribe("test.ns/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.bw.subscribedURIs(); len(got) != 1 || got[0] != "test.ns/a/*" {
+		t.Errorf("subscribed to %v, want test.ns/a/* once", got)
+	}
+	// the shorter chain is preferred
+	if ros := w.bw.subscribes[0].RoutingObjects; len(ros) != 1 || ros[0].(*objects.DChain).NumHashes() != 1 ||
+		!bytes.Equal(ros[0].(*objects.DChain).GetDotHash(0), direct.GetHash()) {
+		t.Errorf("subscribed with %v, want the direct chain", ros)
+	}
+	w.c.Close()
+	drain(t, msgs)
+}
+
+func TestLiveChainsExcludesListOnly(t *testing.T) {
+	w := newTestWorld(t)
+	consume := testChain(t, w.bw.grant(w.ns, w.me, w.ns, "a/*", "C"))
+	listOnly := testChain(t, w.bw.grant(w.ns, w.me, w.ns, "b/*", "L"))
+	live := liveChains([]*objects.DChain{consume, listOnly}, canConsume)
+	if len(live) != 1 || live[0] != consume {
+		t.Errorf("got %d live chains, want only the consume chain", len(live))
+	}
+
+	msgs, err := w.c.MultiSubscribe("test.ns/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.bw.subscribedURIs(); len(got) != 1 || got[0] != "test.ns/a/*" {
+		t.Errorf("subscribed to %v, want only test.ns/a/*", got)
+	}
+	w.c.Close()
+	drain(t, msgs)
+}
+
+func TestFindDOTChainsStdNamespace(t *testing.T) {
+	bw := newFakeBackend()
+	ns, me := newStdEntity(), newEntity()
+	bw.grant(ns, me, ns, "*", "C")
+	c, err := newClientFromBackend(bw, vkOf(me))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dchains, err := c.FindDOTChains(base64.StdEncoding.EncodeToString(ns.GetVK()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dchains) != 1 {
+		t.Errorf("got %d chains with a std base64 namespace, want 1", len(dchains))
+	}
+}
+
+func TestMultiSubscribeTapOnly(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "*", "T")
+	if _, err := w.c.MultiSubscribe("test.ns/a"); err == nil {
+		t.Fatal("subscribed in the default mode with only a tap chain")
+	}
+	if len(w.bw.subscribes) != 0 {
+		t.Fatalf("subscribed %d times in the default mode, want none", len(w.bw.subscribes))
+	}
+
+	for _, mode := range []PermissionMode{ModeTap, ModeConsumeOrTap} {
+		ctx, cancel := context.WithCancel(context.Background())
+		msgs, err := w.c.MultiSubscribeWithParams(ctx, &MultiSubscribeParams{URI: "test.ns/a", Mode: mode})
+		if err != nil {
+			t.Fatalf("mode %d: %v", mode, err)
+		}
+		cancel()
+		drain(t, msgs)
+	}
+	if len(w.bw.subscribes) != 2 {
+		t.Errorf("subscribed %d times, want once per tap mode", len(w.bw.subscribes))
+	}
+}
+
+func TestGetURINamespace(t *testing.T) {
+	vk := vkOf(newEntity())
+	for uri, want := range map[string]string{
+		"scratch.ns":         "scratch.ns",
+		"scratch.ns/a/b":     "scratch.ns",
+		"scratch.ns/*":       "scratch.ns",
+		vk + "/a/+":          vk,
+		"":                   "",
+		"scratch.ns/":        "",
+		"/scratch.ns/a":      "",
+		"*/a":                "",
+		"scratch.ns/a//b":    "",
+		"scratch.ns/a/*/b/*": "",
+	} {
+		if got := GetURINamespace(uri); got != want {
+			t.Errorf("GetURINamespace(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestMultiSubscribeContextCancelsNamespaceResolution(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	w.bw.resolveDelay = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := w.c.MultiSubscribeContext(ctx, "test.ns/a")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if errors.Cause(err) != context.DeadlineExceeded {
+			t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MultiSubscribeContext waited on the registry past its deadline")
+	}
+}
+
+func TestRevocationCheckRetried(t *testing.T) {
+	w := newTestWorld(t)
+	w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	w.bw.failResolves = 1
+	if _, err := w.c.FindDOTChains(vkOf(w.ns)); err == nil {
+		t.Fatal("a failed revocation check didn't fail the search without LookupRetry")
+	}
+
+	w.bw.failResolves = 1
+	w.c.LookupRetry = RetryPolicy{Attempts: 2}
+	dchains, err := w.c.FindDOTChains(vkOf(w.ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dchains) != 1 {
+		t.Errorf("got %d chains, want 1", len(dchains))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// a registry that never answers in time
+	w.bw.resolveDelay = time.Minute
+	if _, err := w.c.noneRevoked(ctx, []*objects.DOT{dchains[0].GetDOT(0)}, make(map[string]bool)); errors.Cause(err) != context.Canceled {
+		t.Errorf("got %v after the context was cancelled, want %v", err, context.Canceled)
+	}
+}
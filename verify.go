@@ -0,0 +1,89 @@
+package bw2util
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/pkg/errors"
+)
+
+// Checks that a chain found earlier still grants access on the URI without searching again: all of
+// its signatures must be valid, it must be an access chain, none of its DOTs may have expired, and
+// it must still overlap the URI. If it no longer grants access, the error says why. The chain must be
+// elaborated; use ElaborateChain first otherwise
+func (c *Client) VerifyChain(dchain *objects.DChain, uri string) (bool, error) {
+	for i := 0; i < dchain.NumHashes(); i++ {
+		if dchain.GetDOT(i) == nil {
+			return false, notElaborated(dchain)
+		}
+	}
+	if !dchain.IsAccess() {
+		return false, fmt.Errorf("Chain %s is not an access chain", fmtHash(dchain.GetChainHash()))
+	}
+	if !dchain.CheckAllSigs() {
+		return false, fmt.Errorf("Chain %s has an invalid signature", fmtHash(dchain.GetChainHash()))
+	}
+	now := time.Now()
+	for i := 0; i < dchain.NumHashes(); i++ {
+		dot := dchain.GetDOT(i)
+		if expiry := dot.GetExpiry(); expiry != nil && expiry.Before(now) {
+			return false, fmt.Errorf("DOT %s in chain %s expired at %s", fmtHash(dot.GetHash()), fmtHash(dchain.GetChainHash()), expiry)
+		}
+	}
+	if _, err := GetDChainURIErr(dchain, uri); err != nil {
+		return false, errors.Wrapf(err, "Chain %s no longer grants %s", fmtHash(dchain.GetChainHash()), uri)
+	}
+	return true, nil
+}
+
+// Returns true if at least one valid chain grants us consume on some or all of the URI, without
+// subscribing. The chain search stops at the first such chain, so this is cheaper than FindDOTChains
+// unless the chains are already cached
+func (c *Client) CanSubscribe(uri string) (bool, error) {
+	return c.canUse(uri, canConsume)
+}
+
+// The publish counterpart of CanSubscribe
+func (c *Client) CanPublish(uri string) (bool, error) {
+	return c.canUse(uri, canPublish)
+}
+
+func (c *Client) canUse(uri string, filter permFilter) (bool, error) {
+	nsvk, err := c.GetNamespaceVK(uri)
+	if err != nil {
+		return false, errors.Wrap(err, "Could not resolve namespace")
+	}
+	if c.ownsNamespace(nsvk) {
+		return true, nil
+	}
+	usable := func(dchain *objects.DChain) bool {
+		return len(liveChains([]*objects.DChain{dchain}, filter)) == 1 && GetDChainURI(dchain, uri) != ""
+	}
+	if cached, found := c.getCachedChains(nsvk, filter); found {
+		for _, dchain := range cached {
+			if usable(dchain) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	var (
+		found   bool
+		revoked = make(map[string]bool)
+	)
+	_, err = c.findDOTChains(context.Background(), nsvk, canonicalVK(c.vk), nsvk, filter, nil, func(dots []*objects.DOT) (bool, error) {
+		dchain, err := c.checkChain(context.Background(), dots, filter, revoked, nil)
+		if err != nil || dchain == nil {
+			return false, err
+		}
+		found = usable(dchain)
+		return found, nil
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "Could not find DOT chains")
+	}
+	return found, nil
+}
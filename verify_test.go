@@ -0,0 +1,29 @@
+package bw2util
+
+import (
+	"testing"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/pkg/errors"
+)
+
+func TestVerifyChain(t *testing.T) {
+	w := newTestWorld(t)
+	dot := w.bw.grant(w.ns, w.me, w.ns, "a/*", "C")
+	dchain, err := objects.CreateDChain(true, dot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := w.c.VerifyChain(dchain, "test.ns/a/b"); !ok || err != nil {
+		t.Fatalf("VerifyChain = %v, %v; want true", ok, err)
+	}
+	if ok, err := w.c.VerifyChain(dchain, "test.ns/b"); ok || errors.Cause(err) != ErrNoOverlap {
+		t.Fatalf("VerifyChain on another URI = %v, %v; want ErrNoOverlap", ok, err)
+	}
+
+	// a chain that only carries the DOT hashes, as when it was held onto and passed around
+	ok, err := w.c.VerifyChain(hashOnly(t, dchain), "test.ns/a/b")
+	if ok || errors.Cause(err) != ErrNotElaborated {
+		t.Fatalf("VerifyChain on an unelaborated chain = %v, %v; want ErrNotElaborated", ok, err)
+	}
+}
@@ -0,0 +1,67 @@
+package bw2util
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// A string encoding for VKs and hashes. Everything this package returns uses VKEncodingURL; EncodeVK
+// and DecodeVK convert at the boundary with systems that expect something else
+type VKEncoding int
+
+const (
+	// URL-safe base64, as used by BOSSWAVE and by this package
+	VKEncodingURL VKEncoding = iota
+	// standard base64
+	VKEncodingStd
+	// lowercase hexadecimal
+	VKEncodingHex
+)
+
+// Encodes a VK or hash in the given encoding
+func EncodeVK(vk []byte, enc VKEncoding) (string, error) {
+	switch enc {
+	case VKEncodingURL:
+		return base64.URLEncoding.EncodeToString(vk), nil
+	case VKEncodingStd:
+		return base64.StdEncoding.EncodeToString(vk), nil
+	case VKEncodingHex:
+		return hex.EncodeToString(vk), nil
+	}
+	return "", fmt.Errorf("Unknown VK encoding %d", enc)
+}
+
+// Decodes a VK or hash from the given encoding
+func DecodeVK(s string, enc VKEncoding) ([]byte, error) {
+	switch enc {
+	case VKEncodingURL:
+		return base64.URLEncoding.DecodeString(s)
+	case VKEncodingStd:
+		return base64.StdEncoding.DecodeString(s)
+	case VKEncodingHex:
+		return hex.DecodeString(s)
+	}
+	return nil, fmt.Errorf("Unknown VK encoding %d", enc)
+}
+
+// returns the VK in the URL-safe base64 encoding used internally, whichever base64 variant it was given in,
+// so VKs can be compared as strings. Anything that isn't a base64 encoded 32 byte VK is returned unchanged
+func canonicalVK(vk string) string {
+	for _, enc := range []*base64.Encoding{base64.URLEncoding, base64.StdEncoding, base64.RawURLEncoding, base64.RawStdEncoding} {
+		if raw, err := enc.DecodeString(vk); err == nil && len(raw) == 32 {
+			return fmtHash(raw)
+		}
+	}
+	return vk
+}
+
+// Re-encodes a VK as returned by this package (e.g. from GetNamespaceVK or in ChainInfo.VKs) in
+// another encoding
+func ConvertVK(vk string, enc VKEncoding) (string, error) {
+	raw, err := DecodeVK(vk, VKEncodingURL)
+	if err != nil {
+		return "", err
+	}
+	return EncodeVK(raw, enc)
+}
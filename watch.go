@@ -0,0 +1,83 @@
+package bw2util
+
+import (
+	"context"
+	"time"
+
+	"github.com/immesys/bw2/objects"
+)
+
+// Whether a chain appeared or disappeared
+type ChainChange int
+
+const (
+	ChainAdded ChainChange = iota
+	ChainRemoved
+)
+
+// Sent by WatchChains when the chains granting us consume on a namespace change
+type ChainChangeEvent struct {
+	Change ChainChange
+	Chain  *objects.DChain
+	// the ChainHash of the chain
+	Hash string
+}
+
+// The shortest interval WatchChains polls the registry at; shorter intervals, including zero and
+// negative ones, are raised to this
+const MinWatchInterval = time.Second
+
+// Re-runs FindDOTChains for the namespace every interval (at least MinWatchInterval), bypassing the
+// chain cache, and reports each chain that appeared or disappeared since the previous run. Chains
+// disappear when one of their DOTs expires (or is about to, see ExpiryGrace) or is revoked. The first
+// run reports every chain as added. A run that fails is logged and ignored. Call the returned function
+// to stop watching; the channel is closed once the watch has stopped
+func (c *Client) WatchChains(namespace string, interval time.Duration) (<-chan ChainChangeEvent, func()) {
+	if interval < MinWatchInterval {
+		interval = MinWatchInterval
+	}
+	events := make(chan ChainChangeEvent, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer close(events)
+		known := make(map[string]*objects.DChain)
+		send := func(ev ChainChangeEvent) bool {
+			select {
+			case events <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			dchains, err := c.buildChains(ctx, namespace, c.vk, namespace, canConsume, nil)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				c.logf("Could not watch chains on %s: %v", namespace, err)
+			} else {
+				current := make(map[string]*objects.DChain)
+				for _, dchain := range dchains {
+					hash := ChainHash(dchain)
+					current[hash] = dchain
+					if _, found := known[hash]; !found && !send(ChainChangeEvent{ChainAdded, dchain, hash}) {
+						return
+					}
+				}
+				for hash, dchain := range known {
+					if _, found := current[hash]; !found && !send(ChainChangeEvent{ChainRemoved, dchain, hash}) {
+						return
+					}
+				}
+				known = current
+			}
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, cancel
+}
@@ -0,0 +1,30 @@
+package bw2util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchChains(t *testing.T) {
+	w := newTestWorld(t)
+	dot := w.bw.grant(w.ns, w.me, w.ns, "*", "C")
+	// a non-positive interval must not poll the registry in a tight loop
+	events, stop := w.c.WatchChains(vkOf(w.ns), 0)
+	select {
+	case ev := <-events:
+		if ev.Change != ChainAdded || fmtHash(ev.Chain.GetDotHash(0)) != fmtHash(dot.GetHash()) {
+			t.Fatalf("got %+v, want the chain to be added", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first run")
+	}
+	time.Sleep(200 * time.Millisecond)
+	stop()
+	for range events {
+	}
+	w.bw.Lock()
+	defer w.bw.Unlock()
+	if len(w.bw.lookups) > 1 {
+		t.Fatalf("the registry was searched %d times within 200ms", len(w.bw.lookups))
+	}
+}